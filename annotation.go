@@ -0,0 +1,151 @@
+package ipcs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/hinshun/ipcs/digestconv"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// AnnotationCIDIndex is the annotation of an image descriptor converted in
+	// annotation mode, whose value is the digest of the CID of its CID index.
+	AnnotationCIDIndex = "com.github.hinshun.ipcs.cid-index"
+
+	// MediaTypeCIDIndex is the media type of a CID index.
+	MediaTypeCIDIndex = "application/vnd.ipcs.cid-index.v1+json"
+)
+
+// CIDIndex maps the digests of the blobs of an image converted in annotation
+// mode to the digests of the CIDs they were added to IPFS as.
+type CIDIndex struct {
+	MediaType string                          `json:"mediaType"`
+	CIDs      map[digest.Digest]digest.Digest `json:"cids"`
+}
+
+// convertAnnotated adds the manifests, configs and layers of an image
+// specified by its descriptor to IPFS as they are, so that the image keeps its
+// digests. The CIDs of its blobs are recorded in a CID index, which is added to
+// IPFS as well and annotated on the returned descriptor. Only the manifests of
+// an index for the selected platforms are converted.
+func (c *converter) convertAnnotated(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var (
+		descs []ocispec.Descriptor
+		seen  = make(map[digest.Digest]struct{})
+	)
+	collect := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if _, ok := seen[desc.Digest]; !ok {
+			seen[desc.Digest] = struct{}{}
+			descs = append(descs, desc)
+		}
+		return nil, nil
+	})
+
+	err := images.Walk(ctx, images.Handlers(
+		collect,
+		images.FilterPlatforms(images.ChildrenHandler(c.provider), c.platform),
+	), desc)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to walk image %q", desc.Digest)
+	}
+
+	dgsts, err := c.copyFiles(ctx, descs)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	idx := CIDIndex{
+		MediaType: MediaTypeCIDIndex,
+		CIDs:      make(map[digest.Digest]digest.Digest, len(descs)),
+	}
+	for i, desc := range descs {
+		idx.CIDs[desc.Digest] = dgsts[i]
+	}
+
+	idxJSON, err := json.MarshalIndent(&idx, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal cid index JSON")
+	}
+
+	idxDigest, err := c.addFile(ctx, files.NewBytesFile(idxJSON))
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to upload cid index")
+	}
+
+	annotated := desc
+	annotated.Annotations = make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotated.Annotations[k] = v
+	}
+	annotated.Annotations[AnnotationCIDIndex] = idxDigest.String()
+
+	return annotated, nil
+}
+
+// importCIDIndex reads the CID index of an image descriptor converted in
+// annotation mode, if it has one, so that the blobs of the image can be
+// resolved by their digests.
+func (s *store) importCIDIndex(ctx context.Context, desc ocispec.Descriptor) error {
+	v, ok := desc.Annotations[AnnotationCIDIndex]
+	if !ok {
+		return nil
+	}
+
+	idxDigest, err := digest.Parse(v)
+	if err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid cid index %q: %v", v, err)
+	}
+
+	c, err := digestconv.DigestToCid(idxDigest)
+	if err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "failed to convert digest %q to cid: %v", idxDigest, err)
+	}
+
+	n, err := s.backend.Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return errors.Wrapf(ipfsError(err), "failed to get cid index %q", idxDigest)
+	}
+
+	f := files.ToFile(n)
+	if f == nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "cid index %q is not a file", idxDigest)
+	}
+	defer f.Close()
+
+	p, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errors.Wrapf(ipfsError(err), "failed to read cid index %q", idxDigest)
+	}
+
+	var idx CIDIndex
+	err = json.Unmarshal(p, &idx)
+	if err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "failed to unmarshal cid index %q: %v", idxDigest, err)
+	}
+
+	if idx.MediaType != MediaTypeCIDIndex {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "unexpected media type %q of cid index %q", idx.MediaType, idxDigest)
+	}
+
+	for alias, dgst := range idx.CIDs {
+		err = digestconv.Validate(dgst)
+		if err != nil {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid cid of %q in cid index %q: %v", alias, idxDigest, err)
+		}
+
+		err = s.addAlias(dgst, alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertAnnotated(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, root, randomData(t, 1<<20), randomData(t, 4096))
+
+	backend := NewMemoryBackend()
+	desc, err := NewConverter(backend, img.provider, WithAnnotationMode()).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	// The image keeps its digest, and is annotated with its CID index.
+	require.Equal(t, img.manifest.Digest, desc.Digest)
+	require.Equal(t, img.manifest.Size, desc.Size)
+	require.Equal(t, img.manifest.MediaType, desc.MediaType)
+	require.Contains(t, desc.Annotations, AnnotationCIDIndex)
+	require.Nil(t, img.manifest.Annotations)
+
+	for _, opts := range [][]StoreOpt{
+		nil,
+		{WithRootDir(root)},
+	} {
+		cs, err := NewContentStoreFromBackend(backend, opts...)
+		require.NoError(t, err)
+
+		// The large layer spans several blocks, so its digest cannot be
+		// resolved until the CID index is imported.
+		_, err = content.ReadBlob(ctx, cs, desc)
+		require.Error(t, err)
+
+		s := cs.(*store)
+		require.NoError(t, s.importCIDIndex(ctx, desc))
+
+		mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+		require.NoError(t, err)
+
+		p, err := content.ReadBlob(ctx, cs, mfst.Config)
+		require.NoError(t, err)
+		require.Equal(t, img.config, p)
+
+		require.Len(t, mfst.Layers, len(img.layers))
+		for i, layer := range mfst.Layers {
+			info, err := cs.Info(ctx, layer.Digest)
+			require.NoError(t, err)
+			require.Equal(t, layer.Digest, info.Digest)
+			require.Equal(t, layer.Size, info.Size)
+
+			p, err := content.ReadBlob(ctx, cs, layer)
+			require.NoError(t, err)
+			require.Equal(t, img.layers[i], p)
+		}
+	}
+
+	// Descriptors without a CID index have nothing to import.
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+	require.NoError(t, cs.(*store).importCIDIndex(ctx, img.manifest))
+}
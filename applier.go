@@ -0,0 +1,201 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/hinshun/ipcs/digestconv"
+	files "github.com/ipfs/go-ipfs-files"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type applier struct {
+	backend  Backend
+	provider content.Provider
+}
+
+// NewApplier returns a diff.Applier that applies file-granular layers, reading
+// their metadata and files from the ipcs content store cs. Other layers are
+// not implemented, so that containerd's diff service falls back to the next
+// applier for them.
+func NewApplier(cs content.Store) (diff.Applier, error) {
+	s, ok := cs.(*store)
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "%T is not an ipcs content store", cs)
+	}
+
+	return &applier{
+		backend:  s.backend,
+		provider: s,
+	}, nil
+}
+
+// Apply applies the file-granular layer specified by its descriptor onto the
+// mounts. The files of the layer are streamed from IPFS as the tar stream of
+// its metadata, so that the layer is applied exactly like the layer it was
+// converted from, whiteouts and opaque directories included.
+//
+// The tar stream is rebuilt from the tar headers of the layer, and must have
+// the diff ID recorded in its metadata, which is the digest of the layer it
+// was converted from. Layers whose bytes cannot be rebuilt, such as ones with
+// padding that archive/tar does not write or with entries replaced by later
+// ones of the same name, fail to apply.
+func (a *applier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount) (d ocispec.Descriptor, err error) {
+	t1 := time.Now()
+	defer func() {
+		if err == nil {
+			log.G(ctx).WithFields(logrus.Fields{
+				"d":     time.Since(t1),
+				"dgst":  desc.Digest,
+				"size":  desc.Size,
+				"media": desc.MediaType,
+			}).Debugf("diff applied")
+		}
+	}()
+
+	if desc.MediaType != MediaTypeUnixfsLayer {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported diff media type: %v", desc.MediaType)
+	}
+
+	meta, err := ReadLayerMetadata(ctx, a.provider, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	var size int64
+	err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		size, err = a.apply(ctx, root, meta)
+		return err
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    meta.DiffID,
+		Size:      size,
+	}, nil
+}
+
+// apply applies the file-granular layer of meta onto root, and returns the
+// size of its tar stream.
+func (a *applier) apply(ctx context.Context, root string, meta LayerMetadata) (int64, error) {
+	if meta.DiffID == "" {
+		return 0, errors.Wrapf(errdefs.ErrInvalidArgument, "layer %q has no diff id", meta.Root)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(a.writeLayer(ctx, pw, meta))
+	}()
+	defer pr.Close()
+
+	// The tar stream is written from the layer metadata and the files of the
+	// layer, so its diff ID is only what the metadata claims until the stream
+	// is digested.
+	digester := digest.Canonical.Digester()
+	rc := &readCounter{r: io.TeeReader(pr, digester.Hash())}
+	_, err := archive.Apply(ctx, root, rc)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to apply layer %q", meta.Root)
+	}
+
+	// Read any trailing data
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return 0, errors.Wrapf(err, "failed to read layer %q", meta.Root)
+	}
+
+	if digester.Digest() != meta.DiffID {
+		return 0, errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected diff id %s of layer %q, expected %s", digester.Digest(), meta.Root, meta.DiffID)
+	}
+
+	return rc.c, nil
+}
+
+// writeLayer writes the tar stream of the file-granular layer of meta to w,
+// reading the content of its regular files from its UnixFS directory.
+func (a *applier) writeLayer(ctx context.Context, w io.Writer, meta LayerMetadata) error {
+	c, err := digestconv.DigestToCid(meta.Root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert digest %q to cid", meta.Root)
+	}
+	root := ipath.IpfsPath(c)
+
+	// The directory only has the content of the last entry of a name, which
+	// replaces the earlier ones anyway.
+	last := make(map[string]int)
+	for i, hdr := range meta.Headers {
+		last[path.Clean("/"+hdr.Name)] = i
+	}
+
+	tw := tar.NewWriter(w)
+	for i, hdr := range meta.Headers {
+		name := path.Clean("/" + hdr.Name)
+		if last[name] != i {
+			continue
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write tar header %q", hdr.Name)
+		}
+
+		if !isRegular(hdr) || hdr.Size == 0 || strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			continue
+		}
+
+		err = a.writeFile(ctx, tw, ipath.Join(root, strings.TrimPrefix(name, "/")))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %q", hdr.Name)
+		}
+	}
+
+	return tw.Close()
+}
+
+func (a *applier) writeFile(ctx context.Context, w io.Writer, p ipath.Path) error {
+	n, err := a.backend.Get(ctx, p)
+	if err != nil {
+		return ipfsError(err)
+	}
+	defer n.Close()
+
+	f := files.ToFile(n)
+	if f == nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "%q is not a file", p)
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func isRegular(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+}
+
+type readCounter struct {
+	r io.Reader
+	c int64
+}
+
+func (rc *readCounter) Read(p []byte) (n int, err error) {
+	n, err = rc.r.Read(p)
+	rc.c += int64(n)
+	return
+}
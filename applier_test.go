@@ -0,0 +1,130 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplier(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var (
+		modTime = time.Unix(1560000000, 0)
+		data    = randomData(t, 1<<20)
+	)
+	tarball, layer := newTestLayer(t,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0600, Uid: 1000, Gid: 1000, ModTime: modTime}, data: data},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.bak", Linkname: "etc/hostname", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/empty", Mode: 0644, ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "var/.wh.cache", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777, ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "tmp/.wh..wh..opq", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "tmp/new", Mode: 0644, ModTime: modTime}, data: []byte("new")},
+	)
+	img := newTestImage(t, root, layer)
+
+	backend := NewMemoryBackend()
+	desc, err := NewConverter(backend, img.provider, WithUnixfsLayers()).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+
+	meta, err := ReadLayerMetadata(ctx, cs, mfst.Layers[0])
+	require.NoError(t, err)
+
+	// The lower layers have files that the layer deletes.
+	rootfs := filepath.Join(root, "rootfs")
+	for _, dir := range []string{"var/cache", "tmp/old"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootfs, dir), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "var/kept"), []byte("kept"), 0644))
+
+	d, err := NewApplier(cs)
+	require.NoError(t, err)
+
+	size, err := d.(*applier).apply(ctx, rootfs, meta)
+	require.NoError(t, err)
+	require.True(t, size > 0)
+	require.Equal(t, digest.FromBytes(tarball), meta.DiffID)
+
+	p, err := ioutil.ReadFile(filepath.Join(rootfs, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, data, p)
+
+	fi, err := os.Stat(filepath.Join(rootfs, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	require.True(t, modTime.Equal(fi.ModTime()))
+
+	bak, err := os.Stat(filepath.Join(rootfs, "etc/hostname.bak"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(fi, bak))
+
+	target, err := os.Readlink(filepath.Join(rootfs, "hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "etc/hostname", target)
+
+	p, err = ioutil.ReadFile(filepath.Join(rootfs, "etc/empty"))
+	require.NoError(t, err)
+	require.Empty(t, p)
+
+	// Whiteouts delete files, and opaque directories hide the lower ones.
+	_, err = os.Stat(filepath.Join(rootfs, "var/cache"))
+	require.True(t, os.IsNotExist(err), "%v", err)
+
+	_, err = os.Stat(filepath.Join(rootfs, "var/kept"))
+	require.NoError(t, err)
+
+	entries, err := ioutil.ReadDir(filepath.Join(rootfs, "tmp"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "new", entries[0].Name())
+
+	// Layers whose tar stream does not have the diff ID that their metadata
+	// claims are rejected.
+	tampered := filepath.Join(root, "tampered")
+	require.NoError(t, os.MkdirAll(tampered, 0755))
+
+	meta.DiffID = digest.FromString("tampered")
+	_, err = d.(*applier).apply(ctx, tampered, meta)
+	require.True(t, errdefs.IsFailedPrecondition(err), "%v", err)
+
+	// Other layers are left to the next applier.
+	_, err = d.Apply(ctx, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip}, nil)
+	require.True(t, errdefs.IsNotImplemented(err), "%v", err)
+}
+
+func TestApplierNotIPCS(t *testing.T) {
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	cs, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	_, err = NewApplier(cs)
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+}
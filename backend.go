@@ -0,0 +1,80 @@
+package ipcs
+
+import (
+	"context"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Backend is the part of IPFS that ipcs is built on.
+type Backend interface {
+	// Add adds a file or directory and returns the path of its root node.
+	Add(ctx context.Context, n files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error)
+
+	// Get returns the UnixFS file or directory at p.
+	Get(ctx context.Context, p path.Path) (files.Node, error)
+
+	// Pin pins the node at p.
+	Pin(ctx context.Context, p path.Path, opts ...options.PinAddOption) error
+
+	// Unpin removes the pin of the node at p.
+	Unpin(ctx context.Context, p path.Path, opts ...options.PinRmOption) error
+
+	// Pins lists the pinned nodes.
+	Pins(ctx context.Context, opts ...options.PinLsOption) ([]iface.Pin, error)
+
+	// Dag returns a getter for the nodes of DAGs, to resolve them node by
+	// node.
+	Dag() ipld.NodeGetter
+
+	// Offline returns the same backend, restricted to the nodes it has
+	// locally.
+	Offline() (Backend, error)
+}
+
+type coreAPIBackend struct {
+	api iface.CoreAPI
+}
+
+// NewCoreAPIBackend returns a backend for an IPFS CoreAPI, such as the HTTP
+// client of an IPFS daemon.
+func NewCoreAPIBackend(api iface.CoreAPI) Backend {
+	return &coreAPIBackend{api: api}
+}
+
+func (b *coreAPIBackend) Add(ctx context.Context, n files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error) {
+	return b.api.Unixfs().Add(ctx, n, opts...)
+}
+
+func (b *coreAPIBackend) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	return b.api.Unixfs().Get(ctx, p)
+}
+
+func (b *coreAPIBackend) Pin(ctx context.Context, p path.Path, opts ...options.PinAddOption) error {
+	return b.api.Pin().Add(ctx, p, opts...)
+}
+
+func (b *coreAPIBackend) Unpin(ctx context.Context, p path.Path, opts ...options.PinRmOption) error {
+	return b.api.Pin().Rm(ctx, p, opts...)
+}
+
+func (b *coreAPIBackend) Pins(ctx context.Context, opts ...options.PinLsOption) ([]iface.Pin, error) {
+	return b.api.Pin().Ls(ctx, opts...)
+}
+
+func (b *coreAPIBackend) Dag() ipld.NodeGetter {
+	return b.api.Dag()
+}
+
+func (b *coreAPIBackend) Offline() (Backend, error) {
+	api, err := b.api.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return nil, err
+	}
+
+	return &coreAPIBackend{api: api}, nil
+}
@@ -0,0 +1,117 @@
+package ipcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketKeyConversions = []byte("conversions")
+
+// ConversionCache is a local index of what the blobs of converted images were
+// added to IPFS as, so that converting them again can skip both fetching and
+// adding them.
+type ConversionCache struct {
+	db *bolt.DB
+}
+
+// conversion is what a blob was added to IPFS as. Conversions are keyed by the
+// digest of the source blob, under the options it was added with.
+type conversion struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// OpenConversionCache opens or creates the conversion cache at path.
+func OpenConversionCache(path string) (*ConversionCache, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open conversion cache %q", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketKeyConversions)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to create conversion cache bucket")
+	}
+
+	return &ConversionCache{db: db}, nil
+}
+
+// Close closes the conversion cache.
+func (cc *ConversionCache) Close() error {
+	return cc.db.Close()
+}
+
+// lookup returns the conversion of the blob src added with the options keyed
+// by opts, and whether there is one.
+func (cc *ConversionCache) lookup(opts string, src digest.Digest) (conversion, bool, error) {
+	var (
+		conv conversion
+		ok   bool
+	)
+	err := cc.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketKeyConversions).Bucket([]byte(opts))
+		if bkt == nil {
+			return nil
+		}
+
+		data := bkt.Get([]byte(src))
+		if data == nil {
+			return nil
+		}
+
+		ok = true
+		return json.Unmarshal(data, &conv)
+	})
+	if err != nil {
+		return conversion{}, false, errors.Wrapf(err, "failed to look up conversion of %q", src)
+	}
+
+	return conv, ok, nil
+}
+
+// add records the conversion of the blob src added with the options keyed by
+// opts.
+func (cc *ConversionCache) add(opts string, src digest.Digest, conv conversion) error {
+	data, err := json.Marshal(&conv)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal conversion of %q", src)
+	}
+
+	// Conversions are added by the parallel uploads of a conversion, so they
+	// are batched.
+	err = cc.db.Batch(func(tx *bolt.Tx) error {
+		bkt, err := tx.Bucket(bucketKeyConversions).CreateBucketIfNotExists([]byte(opts))
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put([]byte(src), data)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to add conversion of %q", src)
+	}
+
+	return nil
+}
+
+// addOptionsKey returns the key of the options that change what content is
+// added to IPFS as.
+func addOptionsKey(opts []options.UnixfsAddOption) (string, error) {
+	settings, prefix, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("chunker=%s,cid-version=%d,codec=%d,hash=%d,raw-leaves=%t,layout=%d",
+		settings.Chunker, prefix.Version, prefix.Codec, prefix.MhType, settings.RawLeaves, settings.Layout), nil
+}
@@ -5,79 +5,197 @@ import (
 	"fmt"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/hinshun/ipcs/digestconv"
-	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
 )
 
 // Client is a client for containerd using ipcs.
 type Client struct {
-	ipfsCln iface.CoreAPI
+	backend Backend
 	ctrdCln *containerd.Client
 	ipcs    *store
+
+	pinMode     PinMode
+	concurrency int
+}
+
+// ClientOpt configures a client.
+type ClientOpt func(*Client)
+
+// WithClientConfig pins fetched content with the pin mode of cfg and fetches
+// at most its MaxConcurrency blobs in parallel. cfg must be valid.
+func WithClientConfig(cfg Config) ClientOpt {
+	return func(c *Client) {
+		c.pinMode = cfg.PinMode
+		c.concurrency = cfg.MaxConcurrency
+	}
 }
 
 // NewClient returns a new ipcs client.
-func NewClient(ipfsCln iface.CoreAPI, ctrdCln *containerd.Client) *Client {
-	return &Client{
-		ipfsCln: ipfsCln,
+func NewClient(backend Backend, ctrdCln *containerd.Client, opts ...ClientOpt) *Client {
+	c := &Client{
+		backend: backend,
 		ctrdCln: ctrdCln,
-		ipcs: &store{
-			cln: ipfsCln,
-		},
+		ipcs:    newStore(backend),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// RemoteOpt configures a fetch or a pull, like containerd's RemoteOpt.
+type RemoteOpt func(*remoteConfig)
+
+type remoteConfig struct {
+	platform     platforms.MatchComparer
+	allPlatforms bool
+	handlers     []images.Handler
+	pinMode      PinMode
+
+	snapshotter string
+	unpack      bool
+	progress    func(UnpackProgress)
+}
+
+// WithPlatformMatcher fetches every manifest of the image that matcher
+// matches, and unpacks the one it matches best, instead of fetching only the
+// manifest of the default platform.
+func WithPlatformMatcher(matcher platforms.MatchComparer) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.platform = matcher
 	}
 }
 
+// WithAllPlatforms fetches the manifests of every platform of the image. A
+// pulled image is still unpacked for a single platform.
+func WithAllPlatforms() RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.allPlatforms = true
+	}
+}
+
+// WithImageHandler runs handler on the content of the image before it is
+// fetched, like the base handlers of containerd's RemoteContext.
+func WithImageHandler(handler images.Handler) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.handlers = append(cfg.handlers, handler)
+	}
+}
+
+// WithPinMode pins the fetched content with mode instead of the pin mode of
+// the client.
+func WithPinMode(mode PinMode) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.pinMode = mode
+	}
+}
+
+// WithPullSnapshotter unpacks the image into snapshots of the snapshotter
+// named snapshotter instead of containerd's default snapshotter.
+func WithPullSnapshotter(snapshotter string) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.snapshotter = snapshotter
+	}
+}
+
+// WithPullUnpack sets whether the image is unpacked after it is fetched, which
+// it is by default.
+func WithPullUnpack(unpack bool) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.unpack = unpack
+	}
+}
+
+// WithPullProgress calls progress after each layer of the image is unpacked.
+func WithPullProgress(progress func(UnpackProgress)) RemoteOpt {
+	return func(cfg *remoteConfig) {
+		cfg.progress = progress
+	}
+}
+
+func (c *Client) remoteConfig(opts []RemoteOpt) (remoteConfig, error) {
+	cfg := remoteConfig{
+		pinMode:     c.pinMode,
+		snapshotter: containerd.DefaultSnapshotter,
+		unpack:      true,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	switch cfg.pinMode {
+	case "", PinRecursive, PinDirect, PinNone:
+	default:
+		return remoteConfig{}, errors.Wrapf(errdefs.ErrInvalidArgument, "unknown pin mode %q", cfg.pinMode)
+	}
+
+	return cfg, nil
+}
+
+// unpackPlatform returns the platform matcher that picks the manifest to
+// unpack.
+func (cfg remoteConfig) unpackPlatform() platforms.MatchComparer {
+	if cfg.platform == nil {
+		return platforms.Default()
+	}
+	return cfg.platform
+}
+
 // Pull pulls an image specified by its descriptor and creates an image named
-// ref.
-func (c *Client) Pull(ctx context.Context, ref string, desc ocispec.Descriptor) (containerd.Image, error) {
+// ref, which is unpacked so that containers can be created from it.
+func (c *Client) Pull(ctx context.Context, ref string, desc ocispec.Descriptor, opts ...RemoteOpt) (containerd.Image, error) {
+	cfg, err := c.remoteConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, done, err := c.ctrdCln.WithLease(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create lease on context")
 	}
 	defer done(ctx)
 
-	img, err := c.Fetch(ctx, ref, desc)
+	img, err := c.fetch(ctx, ref, desc, cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to fetch image")
 	}
 
-	i := containerd.NewImageWithPlatform(c.ctrdCln, img, platforms.Default())
-
-	// if err := i.Unpack(ctx, containerd.DefaultSnapshotter); err != nil {
-	// 	return nil, errors.Wrapf(err, "failed to unpack image on snapshotter %s", containerd.DefaultSnapshotter)
-	// }
+	platform := cfg.unpackPlatform()
+	if cfg.unpack {
+		err = unpack(ctx, c.ctrdCln.ContentStore(), c.ctrdCln.SnapshotService(cfg.snapshotter), c.ctrdCln.DiffService(), img, cfg.snapshotter, platform, cfg.progress)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unpack image on snapshotter %s", cfg.snapshotter)
+		}
+	}
 
-	return i, nil
+	return containerd.NewImageWithPlatform(c.ctrdCln, img, platform), nil
 }
 
-// Fetch fetches all the content referenced by a p2p manifest descriptor.
-func (c *Client) Fetch(ctx context.Context, ref string, desc ocispec.Descriptor) (images.Image, error) {
-	store := c.ctrdCln.ContentStore()
-	fetcher := c.ipcs
+// Fetch fetches all the content referenced by a p2p manifest descriptor. Only
+// the manifest of the default platform is fetched, unless the options choose
+// other platforms.
+func (c *Client) Fetch(ctx context.Context, ref string, desc ocispec.Descriptor, opts ...RemoteOpt) (images.Image, error) {
+	cfg, err := c.remoteConfig(opts)
+	if err != nil {
+		return images.Image{}, err
+	}
 
-	// Get all the children for a descriptor
-	childrenHandler := images.ChildrenHandler(store)
-	// Set any children labels for that content
-	childrenHandler = images.SetChildrenLabels(store, childrenHandler)
-	// Filter children by platforms
-	childrenHandler = images.FilterPlatforms(childrenHandler, platforms.Default())
-	// Sort and limit manifests if a finite number is needed
-	childrenHandler = images.LimitManifests(childrenHandler, platforms.Default(), 1)
-
-	handler := images.Handlers(
-		PinHandler(c.ipfsCln),
-		remotes.FetchHandler(store, fetcher),
-		childrenHandler,
-	)
+	return c.fetch(ctx, ref, desc, cfg)
+}
 
-	if err := images.Dispatch(ctx, handler, desc); err != nil {
+func (c *Client) fetch(ctx context.Context, ref string, desc ocispec.Descriptor, cfg remoteConfig) (images.Image, error) {
+	err := c.fetchContent(ctx, c.ctrdCln.ContentStore(), desc, cfg)
+	if err != nil {
 		return images.Image{}, err
 	}
 
@@ -111,6 +229,47 @@ func (c *Client) Fetch(ctx context.Context, ref string, desc ocispec.Descriptor)
 	}
 }
 
+// fetchContent fetches the content of the image specified by desc that cfg
+// chooses into store, pinning it as it is fetched.
+func (c *Client) fetchContent(ctx context.Context, store content.Store, desc ocispec.Descriptor, cfg remoteConfig) error {
+	fetcher := c.ipcs
+
+	// Get all the children for a descriptor
+	childrenHandler := images.ChildrenHandler(store)
+	// Set any children labels for that content
+	childrenHandler = images.SetChildrenLabels(store, childrenHandler)
+	switch {
+	case cfg.allPlatforms:
+	case cfg.platform != nil:
+		// Filter children by platforms
+		childrenHandler = images.FilterPlatforms(childrenHandler, cfg.platform)
+	default:
+		// Filter children by platforms
+		childrenHandler = images.FilterPlatforms(childrenHandler, platforms.Default())
+		// Sort and limit manifests if a finite number is needed
+		childrenHandler = images.LimitManifests(childrenHandler, platforms.Default(), 1)
+	}
+
+	fetchHandler := remotes.FetchHandler(store, fetcher)
+	if c.concurrency > 0 {
+		fetchHandler = limitHandler(fetchHandler, semaphore.NewWeighted(int64(c.concurrency)))
+	}
+
+	// Images converted in annotation mode keep their digests, which are
+	// resolved to CIDs through their CID index.
+	if err := c.ipcs.importCIDIndex(ctx, desc); err != nil {
+		return err
+	}
+
+	handler := images.Handlers(append(cfg.handlers,
+		c.pinHandler(cfg.pinMode),
+		fetchHandler,
+		childrenHandler,
+	)...)
+
+	return images.Dispatch(ctx, handler, desc)
+}
+
 // Push is unimplemented. If reference resolution is centralized in a
 // metadata-only registry, push may just update the tag to new p2p manifest
 // digest.
@@ -119,30 +278,93 @@ func (c *Client) Push(ctx context.Context, ref string, desc ocispec.Descriptor)
 	return nil
 }
 
-// PinHandler returns a handler that will recursive pin all content discovered
-// in a call to Dispatch. Use with ChildrenHandler to do a full recursive pin.
-func PinHandler(ipfsCln iface.CoreAPI) images.HandlerFunc {
+// PinHandler returns a handler that will pin all content discovered in a call
+// to Dispatch with the given pin mode, recursively if it is empty. Use with
+// ChildrenHandler to do a full recursive pin.
+func PinHandler(backend Backend, mode PinMode) images.HandlerFunc {
 	return func(ctx context.Context, desc ocispec.Descriptor) (subdescs []ocispec.Descriptor, err error) {
 		switch desc.MediaType {
 		case images.MediaTypeDockerSchema1Manifest:
 			return nil, fmt.Errorf("%v not supported", desc.MediaType)
 		default:
-			err := pin(ctx, ipfsCln, desc)
+			err := pin(ctx, backend, desc, mode)
+			return nil, err
+		}
+	}
+}
+
+// pinHandler is like PinHandler, except that it resolves the digests of the
+// content through ipcs, so that images converted in annotation mode are pinned
+// by the CIDs of their blobs.
+func (c *Client) pinHandler(mode PinMode) images.HandlerFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) (subdescs []ocispec.Descriptor, err error) {
+		if desc.MediaType == images.MediaTypeDockerSchema1Manifest {
+			return nil, fmt.Errorf("%v not supported", desc.MediaType)
+		}
+
+		root, _, err := c.ipcs.resolve(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		err = pinPath(ctx, c.backend, path.IpfsPath(root), mode)
+		if err != nil || desc.MediaType != MediaTypeUnixfsLayer || mode == PinNone {
+			return nil, err
+		}
+
+		// The files of file-granular layers are only referred to by their
+		// metadata, so they are pinned as well.
+		meta, err := ReadLayerMetadata(ctx, c.ipcs, desc)
+		if err != nil {
 			return nil, err
 		}
+
+		files, err := digestconv.DigestToCid(meta.Root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to convert digest %q to cid", meta.Root)
+		}
+
+		return nil, pinPath(ctx, c.backend, path.IpfsPath(files), mode)
 	}
 }
 
-func pin(ctx context.Context, ipfsCln iface.CoreAPI, desc ocispec.Descriptor) error {
+func pin(ctx context.Context, backend Backend, desc ocispec.Descriptor, mode PinMode) error {
 	c, err := digestconv.DigestToCid(desc.Digest)
 	if err != nil {
 		return errors.Wrapf(err, "failed to convert digest %q to cid", desc.Digest)
 	}
 
-	err = ipfsCln.Pin().Add(ctx, path.IpfsPath(c))
+	return pinPath(ctx, backend, path.IpfsPath(c), mode)
+}
+
+// pinPath pins p with the given pin mode, recursively if it is empty.
+func pinPath(ctx context.Context, backend Backend, p path.Path, mode PinMode) error {
+	var err error
+	switch mode {
+	case PinNone:
+		return nil
+	case PinDirect:
+		err = backend.Pin(ctx, p, options.Pin.Recursive(false))
+	default:
+		err = backend.Pin(ctx, p)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to pin %q", c)
+		return errors.Wrapf(ipfsError(err), "failed to pin %q", p)
 	}
 
 	return nil
 }
+
+// limitHandler returns a handler that runs handler at most as many times in
+// parallel as sem allows.
+func limitHandler(handler images.Handler, sem *semaphore.Weighted) images.HandlerFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		err := sem.Acquire(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		defer sem.Release(1)
+
+		return handler.Handle(ctx, desc)
+	}
+}
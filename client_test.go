@@ -0,0 +1,165 @@
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRemoteConfig(t *testing.T) {
+	c := NewClient(NewMemoryBackend(), nil, WithClientConfig(Config{PinMode: PinDirect}))
+
+	cfg, err := c.remoteConfig(nil)
+	require.NoError(t, err)
+	require.Equal(t, PinDirect, cfg.pinMode)
+	require.Equal(t, containerd.DefaultSnapshotter, cfg.snapshotter)
+	require.True(t, cfg.unpack)
+	require.Nil(t, cfg.platform)
+
+	arm64 := platforms.MustParse("linux/arm64")
+	cfg, err = c.remoteConfig([]RemoteOpt{
+		WithPinMode(PinNone),
+		WithPlatformMatcher(platforms.Only(arm64)),
+		WithPullUnpack(false),
+	})
+	require.NoError(t, err)
+	require.Equal(t, PinNone, cfg.pinMode)
+	require.False(t, cfg.unpack)
+	require.True(t, cfg.unpackPlatform().Match(arm64))
+
+	_, err = c.remoteConfig([]RemoteOpt{WithPinMode("indirect")})
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+}
+
+func TestClientFetch(t *testing.T) {
+	var (
+		host    = platforms.DefaultSpec()
+		windows = ocispec.Platform{OS: "windows", Architecture: "amd64"}
+	)
+
+	for _, tc := range []struct {
+		name    string
+		opts    []RemoteOpt
+		fetched []ocispec.Platform
+		pinType string
+	}{
+		{
+			name:    "default platform",
+			fetched: []ocispec.Platform{host},
+			pinType: "recursive",
+		},
+		{
+			name:    "platform matcher",
+			opts:    []RemoteOpt{WithPlatformMatcher(platforms.Only(windows))},
+			fetched: []ocispec.Platform{windows},
+			pinType: "recursive",
+		},
+		{
+			name:    "all platforms",
+			opts:    []RemoteOpt{WithAllPlatforms()},
+			fetched: []ocispec.Platform{host, windows},
+			pinType: "recursive",
+		},
+		{
+			name:    "direct pins",
+			opts:    []RemoteOpt{WithAllPlatforms(), WithPinMode(PinDirect)},
+			fetched: []ocispec.Platform{host, windows},
+			pinType: "direct",
+		},
+		{
+			name:    "no pins",
+			opts:    []RemoteOpt{WithPinMode(PinNone)},
+			fetched: []ocispec.Platform{host},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "ipcs-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(root)
+
+			backend := NewMemoryBackend()
+			imgs := make(map[string]testImage)
+			for _, platform := range []ocispec.Platform{host, windows} {
+				imgs[platform.OS] = writeTestImage(t, nil, platform, [][]byte{randomData(t, 4096)}, withTestBackend(backend))
+			}
+			index := writeTestIndex(t, imgs[host.OS], imgs[windows.OS])
+
+			// Content is fetched into containerd's metadata content store over
+			// ipcs, which leaves pinning to the fetch.
+			s := newStore(backend)
+			s.pinMode = PinNone
+
+			mdb, bdb := newTestMetadataDB(t, root, s)
+			defer bdb.Close()
+
+			var (
+				ctx = namespaces.WithNamespace(context.Background(), "test")
+				cs  = mdb.ContentStore()
+				c   = NewClient(backend, nil)
+
+				mu      sync.Mutex
+				handled []digest.Digest
+			)
+
+			record := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				handled = append(handled, desc.Digest)
+				return nil, nil
+			})
+
+			cfg, err := c.remoteConfig(append(tc.opts, WithImageHandler(record)))
+			require.NoError(t, err)
+			require.NoError(t, c.fetchContent(ctx, cs, index, cfg))
+
+			pinTypes := make(map[digest.Digest]string)
+			for pinType, opt := range map[string]options.PinLsOption{
+				"recursive": options.Pin.Type.Recursive(),
+				"direct":    options.Pin.Type.Direct(),
+			} {
+				pins, err := backend.Pins(ctx, opt)
+				require.NoError(t, err)
+				for _, pin := range pins {
+					pinTypes[pinDigest(t, pin)] = pinType
+				}
+			}
+
+			expected := []digest.Digest{index.Digest}
+			for _, platform := range tc.fetched {
+				for _, desc := range imgs[platform.OS].blobs {
+					expected = append(expected, desc.Digest)
+				}
+			}
+
+			// The image handler runs on exactly the content that is fetched.
+			require.ElementsMatch(t, expected, handled)
+
+			for _, img := range imgs {
+				for _, desc := range append([]ocispec.Descriptor{index}, img.blobs...) {
+					_, err := cs.Info(ctx, desc.Digest)
+					if !containsDigest(expected, desc.Digest) {
+						require.True(t, errdefs.IsNotFound(err), "%v", err)
+						require.Empty(t, pinTypes[desc.Digest], desc.MediaType)
+						continue
+					}
+
+					require.NoError(t, err, desc.MediaType)
+					require.Equal(t, tc.pinType, pinTypes[desc.Digest], desc.MediaType)
+				}
+			}
+		})
+	}
+}
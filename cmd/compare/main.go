@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"sort"
 	"strings"
 
@@ -26,14 +26,29 @@ import (
 )
 
 func main() {
+	chunker := flag.String("chunker", "", "chunker layers are added with, e.g. size-262144 or rabin-262144-524288-1048576")
+	hash := flag.String("hash", "", "multihash function layers are added with, sha2-256 or sha2-512 for CIDv1")
+	layout := flag.String("layout", "", "layout of the DAGs layers are added as, balanced or trickle")
+	unixfsLayers := flag.Bool("unixfs-layers", false, "convert layers to file-granular layers, adding their files individually")
+	flag.Parse()
+
+	opts, err := ipcs.ParseChunkingOpts(*chunker, *hash, *layout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *unixfsLayers {
+		opts = append(opts, ipcs.WithUnixfsLayers())
+	}
+
 	ctx := namespaces.WithNamespace(context.Background(), "ipcs")
-	err := run(ctx, os.Args[1:]...)
+	err = run(ctx, flag.Args(), opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(ctx context.Context, refs ...string) error {
+func run(ctx context.Context, refs []string, opts ...ipcs.ConverterOpt) error {
 	ipfsCln, err := httpapi.NewLocalApi()
 	if err != nil {
 		return errors.Wrap(err, "failed to create ipfs client")
@@ -47,7 +62,7 @@ func run(ctx context.Context, refs ...string) error {
 	descs := make([]ocispec.Descriptor, len(refs))
 	for i, ref := range refs {
 		log.Printf("Converting manifest for %q", ref)
-		desc, err := ConvertManifest(ctx, ipfsCln, ctrdCln, ref)
+		desc, err := ConvertManifest(ctx, ipfsCln, ctrdCln, ref, opts...)
 		if err != nil {
 			return errors.Wrapf(err, "failed to convert manifest for ref %q", ref)
 		}
@@ -90,7 +105,7 @@ func run(ctx context.Context, refs ...string) error {
 	return nil
 }
 
-func ConvertManifest(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *containerd.Client, ref string) (ocispec.Descriptor, error) {
+func ConvertManifest(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *containerd.Client, ref string, opts ...ipcs.ConverterOpt) (ocispec.Descriptor, error) {
 	resolver := docker.NewResolver(docker.ResolverOptions{
 		Client: http.DefaultClient,
 	})
@@ -106,7 +121,8 @@ func ConvertManifest(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *contai
 		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to create fetcher for %q", srcName)
 	}
 
-	converter := ipcs.NewConverter(ipfsCln, contentutil.FromFetcher(fetcher))
+	opts = append([]ipcs.ConverterOpt{ipcs.WithPlatforms(platforms.Default()), ipcs.WithSourceRef(srcName)}, opts...)
+	converter := ipcs.NewConverter(ipcs.NewCoreAPIBackend(ipfsCln), contentutil.FromFetcher(fetcher), opts...)
 	dstDesc, err := converter.Convert(ctx, srcDesc)
 	if err != nil {
 		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to convert %q to ipfs manifest", srcName)
@@ -121,13 +137,31 @@ type BlockParent struct {
 }
 
 func CompareManifestBlocks(ctx context.Context, ipfsCln iface.CoreAPI, blockParentByCid map[string]*BlockParent, ref string, desc ocispec.Descriptor) error {
-	store := ipcs.NewContentStoreFromCoreAPI(ipfsCln)
+	store, err := ipcs.NewContentStoreFromCoreAPI(ipfsCln)
+	if err != nil {
+		return errors.Wrap(err, "failed to create content store")
+	}
+
 	mfst, err := images.Manifest(ctx, store, desc, platforms.Default())
 	if err != nil {
 		return errors.Wrap(err, "failed to get manifest")
 	}
 
 	descriptors := append([]ocispec.Descriptor{desc, mfst.Config}, mfst.Layers...)
+	for _, layer := range mfst.Layers {
+		if layer.MediaType != ipcs.MediaTypeUnixfsLayer {
+			continue
+		}
+
+		// The files of file-granular layers are only referred to by their
+		// metadata.
+		meta, err := ipcs.ReadLayerMetadata(ctx, store, layer)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read metadata of layer %q", layer.Digest)
+		}
+		descriptors = append(descriptors, ocispec.Descriptor{Digest: meta.Root})
+	}
+
 	for _, desc := range descriptors {
 		c, err := digestconv.DigestToCid(desc.Digest)
 		if err != nil {
@@ -2,35 +2,104 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/hinshun/ipcs"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/moby/buildkit/util/contentutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
 
 func main() {
-	if len(os.Args) != 3 {
+	cachePath := flag.String("cache", "./tmp/convert/cache.db", "path of the conversion cache, or empty to not cache conversions")
+	force := flag.Bool("force", false, "convert every blob again, even if the conversion cache has it")
+	chunker := flag.String("chunker", "", "chunker layers are added with, e.g. size-262144 or rabin-262144-524288-1048576")
+	hash := flag.String("hash", "", "multihash function layers are added with, sha2-256 or sha2-512 for CIDv1")
+	layout := flag.String("layout", "", "layout of the DAGs layers are added as, balanced or trickle")
+	unixfsLayers := flag.Bool("unixfs-layers", false, "convert layers to file-granular layers, adding their files individually")
+	annotate := flag.Bool("annotate", false, "keep the digests of the image, recording the CIDs of its blobs in an annotated CID index")
+	snapshotter := flag.String("snapshotter", containerd.DefaultSnapshotter, "snapshotter the converted image is unpacked into")
+	skipUnpack := flag.Bool("skip-unpack", false, "only fetch the converted image, without unpacking it")
+	platform := flag.String("platform", "", "comma-separated platforms whose manifests are pulled, in order of preference for unpacking")
+	allPlatforms := flag.Bool("all-platforms", false, "pull the manifests of every platform")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
 		log.Fatal("convert: requires exactly 2 args")
 	}
 
+	opts, err := ipcs.ParseChunkingOpts(*chunker, *hash, *layout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *cachePath != "" {
+		err := os.MkdirAll(filepath.Dir(*cachePath), 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cc, err := ipcs.OpenConversionCache(*cachePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cc.Close()
+
+		opts = append(opts, ipcs.WithConversionCache(cc))
+	}
+	if *force {
+		opts = append(opts, ipcs.WithForce())
+	}
+	if *unixfsLayers {
+		opts = append(opts, ipcs.WithUnixfsLayers())
+	}
+	if *annotate {
+		opts = append(opts, ipcs.WithAnnotationMode())
+	}
+
+	pullOpts := []ipcs.RemoteOpt{
+		ipcs.WithPullSnapshotter(*snapshotter),
+		ipcs.WithPullUnpack(!*skipUnpack),
+		ipcs.WithPullProgress(func(p ipcs.UnpackProgress) {
+			log.Printf("Unpacked layer %d/%d %q in %s", p.Index+1, p.Total, p.Layer.Digest, p.Duration)
+		}),
+	}
+	if *platform != "" {
+		var ps []ocispec.Platform
+		for _, s := range strings.Split(*platform, ",") {
+			p, err := platforms.Parse(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ps = append(ps, p)
+		}
+		pullOpts = append(pullOpts, ipcs.WithPlatformMatcher(platforms.Ordered(ps...)))
+	}
+	if *allPlatforms {
+		pullOpts = append(pullOpts, ipcs.WithAllPlatforms())
+	}
+
 	ctx := namespaces.WithNamespace(context.Background(), "ipfs")
-	err := run(ctx, os.Args[1], os.Args[2])
+	err = run(ctx, flag.Arg(0), flag.Arg(1), opts, pullOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(ctx context.Context, src, dst string) error {
+func run(ctx context.Context, src, dst string, opts []ipcs.ConverterOpt, pullOpts []ipcs.RemoteOpt) error {
 	ipfsCln, err := httpapi.NewLocalApi()
 	if err != nil {
 		return errors.Wrap(err, "failed to create ipfs client")
@@ -41,7 +110,7 @@ func run(ctx context.Context, src, dst string) error {
 		return errors.Wrap(err, "failed to create containerd client")
 	}
 
-	err = Convert(ctx, ipfsCln, ctrdCln, src, dst)
+	err = Convert(ctx, ipfsCln, ctrdCln, src, dst, opts, pullOpts...)
 	if err != nil {
 		return errors.Wrap(err, "failed to convert to p2p manifest")
 	}
@@ -54,7 +123,7 @@ func run(ctx context.Context, src, dst string) error {
 	return nil
 }
 
-func Convert(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *containerd.Client, src, dst string) error {
+func Convert(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *containerd.Client, src, dst string, opts []ipcs.ConverterOpt, pullOpts ...ipcs.RemoteOpt) error {
 	resolver := docker.NewResolver(docker.ResolverOptions{
 		Client: http.DefaultClient,
 	})
@@ -70,14 +139,15 @@ func Convert(ctx context.Context, ipfsCln iface.CoreAPI, ctrdCln *containerd.Cli
 		return errors.Wrapf(err, "failed to create fetcher for %q", src)
 	}
 
-	converter := ipcs.NewConverter(ipfsCln, contentutil.FromFetcher(fetcher))
+	opts = append(opts, ipcs.WithSourceRef(srcName))
+	converter := ipcs.NewConverter(ipcs.NewCoreAPIBackend(ipfsCln), contentutil.FromFetcher(fetcher), opts...)
 	mfstDesc, err := converter.Convert(ctx, srcDesc)
 	if err != nil {
 		return errors.Wrapf(err, "failed to convert %q to ipfs manifest", srcName)
 	}
 
-	ipcsCln := ipcs.NewClient(ipfsCln, ctrdCln)
-	img, err := ipcsCln.Pull(ctx, dst, mfstDesc)
+	ipcsCln := ipcs.NewClient(ipcs.NewCoreAPIBackend(ipfsCln), ctrdCln)
+	img, err := ipcsCln.Pull(ctx, dst, mfstDesc, pullOpts...)
 	if err != nil {
 		return errors.Wrapf(err, "failed to pull descriptor %q", mfstDesc.Digest)
 	}
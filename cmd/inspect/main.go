@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/containerd/containerd/content"
+	"github.com/hinshun/ipcs"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal("inspect: requires exactly 1 arg")
+	}
+
+	err := run(context.Background(), flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, arg string) error {
+	dgst, err := digest.Parse(arg)
+	if err != nil {
+		return errors.Wrapf(err, "invalid digest %q", arg)
+	}
+
+	ipfsCln, err := httpapi.NewLocalApi()
+	if err != nil {
+		return errors.Wrap(err, "failed to create ipfs client")
+	}
+
+	cs, err := ipcs.NewContentStoreFromCoreAPI(ipfsCln)
+	if err != nil {
+		return errors.Wrap(err, "failed to create ipcs content store")
+	}
+
+	desc, err := Resolve(ctx, cs, dgst)
+	if err != nil {
+		return err
+	}
+
+	prov, err := ipcs.ReadProvenance(ctx, cs, desc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read provenance of %q", dgst)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "   ")
+	return enc.Encode(&prov)
+}
+
+// Resolve returns the descriptor of the manifest or index at dgst. Converted
+// manifests and indexes carry no media type, so indexes are told apart by
+// their manifests.
+func Resolve(ctx context.Context, cs content.Store, dgst digest.Digest) (ocispec.Descriptor, error) {
+	info, err := cs.Info(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to get info of %q", dgst)
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    info.Digest,
+		Size:      info.Size,
+	}
+
+	p, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to read %q", dgst)
+	}
+
+	var probe struct {
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	err = json.Unmarshal(p, &probe)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "%q is not a manifest or index", dgst)
+	}
+
+	if probe.Manifests != nil {
+		desc.MediaType = ocispec.MediaTypeImageIndex
+	}
+
+	return desc, nil
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/plugin"
 	"github.com/hinshun/ipcs"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
@@ -16,22 +21,80 @@ func init() {
 		Config: &ipcs.Config{},
 		InitFn: initIPCSService,
 	})
+
+	plugin.Register(&plugin.Registration{
+		Type: plugin.DiffPlugin,
+		ID:   "ipcs",
+		Requires: []plugin.Type{
+			plugin.ContentPlugin,
+			plugin.MetadataPlugin,
+		},
+		InitFn: initIPCSDiff,
+	})
 }
 
 func initIPCSService(ic *plugin.InitContext) (interface{}, error) {
-	ipfsPath := os.Getenv(httpapi.EnvDir)
-	if ipfsPath == "" {
-		ipfsPath = httpapi.DefaultPathRoot
+	c := *ic.Config.(*ipcs.Config)
+
+	if c.Address == "" && c.IpfsPath == "" && c.Embedded == nil {
+		c.IpfsPath = os.Getenv(httpapi.EnvDir)
+		if c.IpfsPath == "" {
+			c.IpfsPath = httpapi.DefaultPathRoot
+		}
 	}
 
-	c := ipcs.Config{
-		IpfsPath: ipfsPath,
+	if c.RootDir == "" {
+		c.RootDir = ic.Root
 	}
 
-	s, err := ipcs.NewContentStore(c)
+	if c.Embedded != nil && c.Embedded.RepoPath == "" {
+		embedded := *c.Embedded
+		embedded.RepoPath = filepath.Join(ic.Root, "ipfs")
+		c.Embedded = &embedded
+	}
+
+	err := c.Validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "ipcs: invalid config")
+	}
+
+	s, err := ipcs.NewContentStore(ic.Context, c)
 	if err != nil {
 		return nil, errors.Wrap(err, "ipcs: failed to create content store")
 	}
 
 	return s, nil
 }
+
+func initIPCSDiff(ic *plugin.InitContext) (interface{}, error) {
+	cs, err := ic.Get(plugin.ContentPlugin)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := ic.Get(plugin.MetadataPlugin)
+	if err != nil {
+		return nil, err
+	}
+
+	applier, err := ipcs.NewApplier(cs.(content.Store))
+	if err != nil {
+		return nil, errors.Wrap(err, "ipcs: failed to create applier")
+	}
+
+	comparer, err := ipcs.NewComparer(cs.(content.Store), md.(*metadata.DB).ContentStore())
+	if err != nil {
+		return nil, errors.Wrap(err, "ipcs: failed to create comparer")
+	}
+
+	ic.Meta.Platforms = append(ic.Meta.Platforms, platforms.DefaultSpec())
+	return diffPlugin{
+		Applier:  applier,
+		Comparer: comparer,
+	}, nil
+}
+
+type diffPlugin struct {
+	diff.Applier
+	diff.Comparer
+}
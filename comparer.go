@@ -0,0 +1,312 @@
+package ipcs
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// labelUncompressed is the label of compressed layers with their diff ID.
+const labelUncompressed = "containerd.io/uncompressed"
+
+type comparer struct {
+	s  *store
+	cs content.Store
+}
+
+// NewComparer returns a diff.Comparer that adds the changesets between mounts
+// straight to IPFS through the ipcs content store s, rather than writing them
+// to a content store first. Changesets are added as tar blobs, optionally
+// gzipped, or as file-granular layers, and are pinned like content written to
+// s. They are then committed to the content store cs, which must be s or a
+// content store over it, such as containerd's metadata content store in the
+// plugin. cs finds them in s, so that they are committed without being copied,
+// and are visible to clients and referenced for garbage collection like any
+// other content.
+func NewComparer(s, cs content.Store) (diff.Comparer, error) {
+	is, ok := s.(*store)
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "%T is not an ipcs content store", s)
+	}
+
+	return &comparer{s: is, cs: cs}, nil
+}
+
+// Compare adds the changeset between the lower and upper mounts to IPFS, and
+// returns a descriptor whose digest is the digest of its CID. The media type
+// of the changeset defaults to a gzipped tar blob. The changeset is committed
+// under the reference of the options with their labels.
+func (d *comparer) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (desc ocispec.Descriptor, err error) {
+	t1 := time.Now()
+	defer func() {
+		if err == nil {
+			log.G(ctx).WithFields(logrus.Fields{
+				"d":     time.Since(t1),
+				"dgst":  desc.Digest,
+				"size":  desc.Size,
+				"media": desc.MediaType,
+			}).Debugf("diff created")
+		}
+	}()
+
+	var config diff.Config
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	if config.MediaType == "" {
+		config.MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+
+	switch config.MediaType {
+	case ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerGzip, MediaTypeUnixfsLayer:
+	default:
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported diff media type: %v", config.MediaType)
+	}
+
+	err = mount.WithTempMount(ctx, lower, func(lowerRoot string) error {
+		return mount.WithTempMount(ctx, upper, func(upperRoot string) error {
+			desc, err = d.compare(ctx, lowerRoot, upperRoot, config)
+			return err
+		})
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// compare adds the changeset between the lowerRoot and upperRoot directories
+// to IPFS as config.MediaType, and commits it to the content store of the
+// comparer.
+func (d *comparer) compare(ctx context.Context, lowerRoot, upperRoot string, config diff.Config) (ocispec.Descriptor, error) {
+	unixfs := config.MediaType == MediaTypeUnixfsLayer
+
+	// The directory of a file-granular layer is only unpinned along with its
+	// metadata if it was not pinned by anything else before.
+	var pinned map[cid.Cid]bool
+	if unixfs && d.s.pinMode != PinNone {
+		var err error
+		pinned, err = pinnedCids(ctx, d.s.backend)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	compressed := config.MediaType == ocispec.MediaTypeImageLayerGzip
+	digester := digest.Canonical.Digester()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := writeDiff(ctx, pw, digester.Hash(), lowerRoot, upperRoot, compressed)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	var (
+		desc ocispec.Descriptor
+		meta LayerMetadata
+		err  error
+	)
+	if unixfs {
+		desc, meta, err = addLayerFiles(ctx, pr, d.add)
+	} else {
+		desc, err = d.addBlob(ctx, pr, config.MediaType)
+	}
+
+	// A failed add stops the changeset from being written any further.
+	pr.CloseWithError(err)
+	werr := <-done
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if werr != nil {
+		return ocispec.Descriptor{}, errors.Wrap(werr, "failed to write diff")
+	}
+
+	if pinned != nil {
+		err = d.pinFiles(desc.Digest, meta.Root, pinned)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	labels := config.Labels
+	if config.MediaType != ocispec.MediaTypeImageLayer {
+		labels = copyLabels(config.Labels)
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[labelUncompressed] = digester.Digest().String()
+	}
+
+	ref := config.Reference
+	if ref == "" {
+		ref = "ipcs-diff-" + desc.Digest.String()
+	}
+
+	err = d.commit(ctx, ref, desc, labels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// addBlob adds the tar stream r to IPFS as a blob of mediaType.
+func (d *comparer) addBlob(ctx context.Context, r io.Reader, mediaType string) (ocispec.Descriptor, error) {
+	rc := &readCounter{r: r}
+	dgst, err := d.add(ctx, files.NewReaderFile(rc))
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to upload diff")
+	}
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      rc.c,
+	}, nil
+}
+
+// add adds n to IPFS with the options of the content store, and pins it with
+// its pin mode like the content written to it.
+func (d *comparer) add(ctx context.Context, n files.Node) (digest.Digest, error) {
+	// Recursive pins are made by the add itself, so that the content cannot be
+	// garbage collected before it is pinned.
+	recursive := d.s.pinMode == "" || d.s.pinMode == PinRecursive
+	opts := append([]options.UnixfsAddOption{options.Unixfs.Pin(recursive)}, d.s.addOpts...)
+
+	p, err := d.s.backend.Add(ctx, n, opts...)
+	if err != nil {
+		return "", errors.Wrap(ipfsError(err), "failed to put blob to ipfs")
+	}
+
+	if !recursive {
+		err = pinPath(ctx, d.s.backend, p, d.s.pinMode)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	dgst, err := digestconv.CidToDigest(p.Cid())
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to convert cid %q to digest", p.Cid())
+	}
+
+	return dgst, nil
+}
+
+// pinFiles records that the directory at root of a file-granular layer is
+// pinned on behalf of its metadata at dgst, so that deleting the metadata
+// unpins it. Directories that were pinned before, other than on behalf of the
+// metadata of other layers, are left alone.
+func (d *comparer) pinFiles(dgst, root digest.Digest, pinned map[cid.Cid]bool) error {
+	c, err := digestconv.DigestToCid(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert digest %q to cid", root)
+	}
+
+	if pinned[c] {
+		owned, err := d.s.pinnedFor(root)
+		if err != nil || !owned {
+			return err
+		}
+	}
+
+	return d.s.addPin(dgst, root)
+}
+
+// commit commits the changeset at desc, which has been added to IPFS, to the
+// content store of the comparer under ref with labels. A content store over
+// the ipcs content store finds the changeset there, so nothing is written.
+func (d *comparer) commit(ctx context.Context, ref string, desc ocispec.Descriptor, labels map[string]string) error {
+	if d.cs == content.Store(d.s) {
+		// The changeset is already content of the ipcs content store, which
+		// only keeps labels with a metadata root directory.
+		if d.s.meta == nil {
+			return nil
+		}
+		return d.update(ctx, desc.Digest, labels)
+	}
+
+	w, err := content.OpenWriter(ctx, d.cs, content.WithRef(ref), content.WithDescriptor(desc))
+	if err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to open writer for %q", ref)
+		}
+		return d.update(ctx, desc.Digest, labels)
+	}
+	defer w.Close()
+
+	err = w.Commit(ctx, desc.Size, desc.Digest, content.WithLabels(labels))
+	if errdefs.IsAlreadyExists(err) {
+		return d.update(ctx, desc.Digest, labels)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to commit %q", desc.Digest)
+	}
+
+	return nil
+}
+
+// update sets labels on the committed content at dgst.
+func (d *comparer) update(ctx context.Context, dgst digest.Digest, labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	var fieldpaths []string
+	for k := range labels {
+		fieldpaths = append(fieldpaths, "labels."+k)
+	}
+
+	_, err := d.cs.Update(ctx, content.Info{Digest: dgst, Labels: labels}, fieldpaths...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set labels of %q", dgst)
+	}
+	return nil
+}
+
+// writeDiff writes the changeset between the lowerRoot and upperRoot
+// directories as a tar stream to w, gzipped if compressed is set. The
+// uncompressed tar stream is also written to uncompressed, so that its diff ID
+// can be computed.
+func writeDiff(ctx context.Context, w, uncompressed io.Writer, lowerRoot, upperRoot string, compressed bool) error {
+	if !compressed {
+		return archive.WriteDiff(ctx, io.MultiWriter(w, uncompressed), lowerRoot, upperRoot)
+	}
+
+	cw, err := compression.CompressStream(w, compression.Gzip)
+	if err != nil {
+		return errors.Wrap(err, "failed to get compressed stream")
+	}
+
+	err = archive.WriteDiff(ctx, io.MultiWriter(cw, uncompressed), lowerRoot, upperRoot)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
@@ -0,0 +1,256 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/hinshun/ipcs/digestconv"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDirs writes the lower and upper directories of a changeset to root,
+// which modifies, deletes and adds files.
+func newTestDirs(t *testing.T, root string) (string, string) {
+	lower, upper := filepath.Join(root, "lower"), filepath.Join(root, "upper")
+	modTime := time.Unix(1560000000, 0)
+	for _, dir := range []string{lower, upper} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0755))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "var"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "var/kept"), []byte("kept"), 0644))
+
+		// Unchanged files are only left out of the changeset if their
+		// modification times match.
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "var/kept"), modTime, modTime))
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(lower, "etc/hostname"), []byte("lower"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(lower, "var/cache"), 0755))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, "etc/hostname"), []byte("upper host"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(upper, "tmp"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, "tmp/new"), randomData(t, 1<<20), 0644))
+
+	return lower, upper
+}
+
+func TestComparer(t *testing.T) {
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	lower, upper := newTestDirs(t, root)
+
+	backend := NewMemoryBackend()
+	cs, err := NewContentStoreFromBackend(backend, WithRootDir(filepath.Join(root, "meta")))
+	require.NoError(t, err)
+
+	// Changesets are committed to containerd's metadata content store, like
+	// the plugin does.
+	mdb, bdb := newTestMetadataDB(t, root, cs)
+	defer bdb.Close()
+	mcs := mdb.ContentStore()
+
+	ctx := namespaces.WithNamespace(context.Background(), "test")
+
+	d, err := NewComparer(cs, mcs)
+	require.NoError(t, err)
+
+	compare := func(opts ...diff.Opt) ocispec.Descriptor {
+		var config diff.Config
+		for _, opt := range opts {
+			require.NoError(t, opt(&config))
+		}
+		if config.MediaType == "" {
+			config.MediaType = ocispec.MediaTypeImageLayerGzip
+		}
+
+		desc, err := d.(*comparer).compare(ctx, lower, upper, config)
+		require.NoError(t, err)
+		return desc
+	}
+
+	// Changesets default to gzipped tar blobs labeled with their diff ID,
+	// which are visible to clients of the namespace.
+	desc := compare(diff.WithLabels(map[string]string{"test": "label"}))
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, desc.MediaType)
+
+	info, err := mcs.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, desc.Size, info.Size)
+	require.Equal(t, "label", info.Labels["test"])
+
+	_, err = mcs.Info(namespaces.WithNamespace(ctx, "other"), desc.Digest)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	// Their digests are the digests of their CIDs, so any store over the same
+	// IPFS node has them.
+	other, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	_, err = other.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+
+	ra, err := mcs.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	zr, err := gzip.NewReader(content.NewReader(ra))
+	require.NoError(t, err)
+
+	digester := digest.Canonical.Digester()
+	tr := tar.NewReader(io.TeeReader(zr, digester.Hash()))
+
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	_, err = io.Copy(ioutil.Discard, tr)
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{"etc/", "etc/hostname", "tmp/", "tmp/new", "var/", "var/.wh.cache"}, names)
+	require.Equal(t, digester.Digest().String(), info.Labels[labelUncompressed])
+
+	// Uncompressed changesets have no diff ID label, since their bytes are
+	// their diff ID.
+	desc = compare(diff.WithMediaType(ocispec.MediaTypeImageLayer))
+	require.Equal(t, ocispec.MediaTypeImageLayer, desc.MediaType)
+
+	info, err = mcs.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels[labelUncompressed])
+
+	// File-granular layers are labeled with the diff ID of their metadata.
+	desc = compare(diff.WithMediaType(MediaTypeUnixfsLayer))
+	require.Equal(t, MediaTypeUnixfsLayer, desc.MediaType)
+
+	meta, err := ReadLayerMetadata(ctx, mcs, desc)
+	require.NoError(t, err)
+
+	info, err = mcs.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, meta.DiffID.String(), info.Labels[labelUncompressed])
+
+	// Comparing again under a reference finds the existing layer metadata.
+	require.Equal(t, desc, compare(diff.WithMediaType(MediaTypeUnixfsLayer), diff.WithReference("test-ref")))
+
+	// Applying the changeset onto the lower directory results in the upper
+	// one.
+	a, err := NewApplier(cs)
+	require.NoError(t, err)
+
+	_, err = a.(*applier).apply(ctx, lower, meta)
+	require.NoError(t, err)
+
+	for _, name := range []string{"etc/hostname", "tmp/new", "var/kept"} {
+		expected, err := ioutil.ReadFile(filepath.Join(upper, name))
+		require.NoError(t, err)
+
+		actual, err := ioutil.ReadFile(filepath.Join(lower, name))
+		require.NoError(t, err, name)
+		require.Equal(t, expected, actual, name)
+	}
+
+	_, err = os.Stat(filepath.Join(lower, "var/cache"))
+	require.True(t, os.IsNotExist(err), "%v", err)
+
+	// Garbage collecting the layer metadata unpins its files as well.
+	files, err := digestconv.DigestToCid(meta.Root)
+	require.NoError(t, err)
+
+	pinned, err := pinnedCids(ctx, backend)
+	require.NoError(t, err)
+	require.True(t, pinned[files])
+
+	require.NoError(t, mcs.Delete(ctx, desc.Digest))
+	_, err = mdb.GarbageCollect(ctx)
+	require.NoError(t, err)
+
+	pinned, err = pinnedCids(ctx, backend)
+	require.NoError(t, err)
+	require.False(t, pinned[files])
+
+	// Other changesets are left to the next comparer.
+	_, err = d.Compare(ctx, nil, nil, diff.WithMediaType("application/vnd.ipcs.test"))
+	require.True(t, errdefs.IsNotImplemented(err), "%v", err)
+}
+
+func TestComparerSharedFiles(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	lower, upper := newTestDirs(t, root)
+
+	backend := NewMemoryBackend()
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	d, err := NewComparer(cs, cs)
+	require.NoError(t, err)
+
+	compare := func() (ocispec.Descriptor, LayerMetadata) {
+		desc, err := d.(*comparer).compare(ctx, lower, upper, diff.Config{MediaType: MediaTypeUnixfsLayer})
+		require.NoError(t, err)
+
+		meta, err := ReadLayerMetadata(ctx, cs, desc)
+		require.NoError(t, err)
+		return desc, meta
+	}
+
+	// Touching a file changes the metadata of the layer, but not its files.
+	first, meta := compare()
+	modTime := time.Unix(1570000000, 0)
+	require.NoError(t, os.Chtimes(filepath.Join(upper, "etc/hostname"), modTime, modTime))
+	second, other := compare()
+	require.NotEqual(t, first.Digest, second.Digest)
+	require.Equal(t, meta.Root, other.Root)
+
+	files, err := digestconv.DigestToCid(meta.Root)
+	require.NoError(t, err)
+
+	isPinned := func() bool {
+		pinned, err := pinnedCids(ctx, backend)
+		require.NoError(t, err)
+		return pinned[files]
+	}
+
+	// The files stay pinned until the metadata of every layer is deleted.
+	require.NoError(t, cs.Delete(ctx, first.Digest))
+	require.True(t, isPinned())
+
+	require.NoError(t, cs.Delete(ctx, second.Digest))
+	require.False(t, isPinned())
+}
+
+func TestComparerNotIPCS(t *testing.T) {
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	cs, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	_, err = NewComparer(cs, cs)
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+}
@@ -0,0 +1,362 @@
+package ipcs
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	multihash "github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of ipcs. As a containerd plugin, it is read from
+// the [plugins.ipcs] section of containerd's config.toml.
+type Config struct {
+	// IpfsPath is the IPFS repository whose api file holds the address of the
+	// IPFS API. It is only used when Address is empty.
+	IpfsPath string `toml:"ipfs_path"`
+
+	// Embedded runs an IPFS node in the same process as ipcs instead of
+	// connecting to the API of an IPFS daemon. It requires ipcs to be built
+	// with the embedded build tag.
+	Embedded *EmbeddedConfig `toml:"embedded"`
+
+	// Address is the multiaddr of the IPFS API, either over TCP (e.g.
+	// /ip4/127.0.0.1/tcp/5001) or a unix socket (e.g. /unix/run/ipfs.sock).
+	Address string `toml:"address"`
+
+	// Headers are added to every request to the IPFS API, e.g. for
+	// authentication.
+	Headers map[string]string `toml:"headers"`
+
+	// Timeout bounds connecting to the IPFS API and waiting for it to start
+	// responding to a request. Streaming the response is not bounded. Zero
+	// means no timeout.
+	Timeout Duration `toml:"timeout"`
+
+	// ProbeTimeout bounds checking whether IPFS has content locally. Zero
+	// means the default of 5 seconds.
+	ProbeTimeout Duration `toml:"probe_timeout"`
+
+	// Offline restricts ipcs to the blocks IPFS has locally, so that it never
+	// fetches content from the network, e.g. on air-gapped hosts.
+	Offline bool `toml:"offline"`
+
+	// PinMode is how content is pinned, whether it is written to the store,
+	// fetched by the client or added by the converter. Content that is not
+	// pinned recursively may partly be garbage collected by IPFS, and content
+	// that is not pinned at all is not walked by the store. Empty means
+	// recursive.
+	PinMode PinMode `toml:"pin_mode"`
+
+	// Chunker is the IPFS chunker content is added with, e.g. size-262144 or
+	// rabin-262144-524288-1048576. Empty means the IPFS default.
+	Chunker string `toml:"chunker"`
+
+	// Hash is the multihash function content is added with, sha2-256 or
+	// sha2-512, as containerd only supports sha256 and sha512 digests. Content
+	// hashed with sha2-512 is added as CIDv1. Empty means sha2-256.
+	Hash string `toml:"hash"`
+
+	// MaxConcurrency is the number of requests made to IPFS in parallel when
+	// walking the store, fetching images or adding the blobs of converted
+	// images. Zero means the default.
+	MaxConcurrency int `toml:"max_concurrency"`
+
+	// RootDir is the directory where ipcs keeps its local metadata. Labels and
+	// timestamps of content are not persisted when it is empty, and content
+	// can then only be looked up by the digest of its CID rather than also by
+	// the sha256 of its bytes. Committing content that already exists is then
+	// also not reported as such.
+	RootDir string `toml:"root_dir"`
+}
+
+// EmbeddedConfig configures an IPFS node embedded in ipcs.
+type EmbeddedConfig struct {
+	// RepoPath is the IPFS repository of the node, which is initialized if it
+	// does not exist yet. It is not used by the memory datastore.
+	RepoPath string `toml:"repo_path"`
+
+	// Bootstrap are the multiaddrs of the peers the node connects to when it
+	// starts. Unset means the IPFS default bootstrap peers, and an empty list
+	// none at all.
+	Bootstrap *[]string `toml:"bootstrap"`
+
+	// SwarmAddresses are the multiaddrs the node listens on for peers. Empty
+	// means the IPFS defaults.
+	SwarmAddresses []string `toml:"swarm_addresses"`
+
+	// Datastore is where the node keeps its blocks. Empty means the IPFS
+	// default.
+	Datastore Datastore `toml:"datastore"`
+}
+
+// Datastore is a kind of datastore an embedded IPFS node keeps its blocks in.
+type Datastore string
+
+const (
+	// DatastoreFlatfs keeps blocks as files in the repository, like IPFS does
+	// by default.
+	DatastoreFlatfs Datastore = "flatfs"
+
+	// DatastoreBadger keeps blocks in a badger database in the repository.
+	DatastoreBadger Datastore = "badger"
+
+	// DatastoreMemory keeps blocks in memory, so that nothing outlives the
+	// node.
+	DatastoreMemory Datastore = "memory"
+)
+
+// PinMode is how content is pinned in IPFS.
+type PinMode string
+
+const (
+	// PinRecursive pins content and every block it links to.
+	PinRecursive PinMode = "recursive"
+
+	// PinDirect pins only the root block of content.
+	PinDirect PinMode = "direct"
+
+	// PinNone does not pin content, leaving it to be garbage collected by
+	// IPFS.
+	PinNone PinMode = "none"
+)
+
+// Duration is a time.Duration that is read from config.toml as a string such
+// as "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Validate returns an error if any of the values in the config is invalid.
+func (cfg Config) Validate() error {
+	if cfg.Address != "" {
+		_, err := apiAddr(cfg.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Embedded != nil {
+		if cfg.Address != "" {
+			return errors.Wrap(errdefs.ErrInvalidArgument, "address must be empty with an embedded ipfs node")
+		}
+
+		err := cfg.Embedded.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for k := range cfg.Headers {
+		if k == "" {
+			return errors.Wrap(errdefs.ErrInvalidArgument, "header name must not be empty")
+		}
+	}
+
+	if cfg.Timeout < 0 {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "timeout must not be negative: %s", time.Duration(cfg.Timeout))
+	}
+
+	if cfg.ProbeTimeout < 0 {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "probe timeout must not be negative: %s", time.Duration(cfg.ProbeTimeout))
+	}
+
+	switch cfg.PinMode {
+	case "", PinRecursive, PinDirect, PinNone:
+	default:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "unknown pin mode %q", cfg.PinMode)
+	}
+
+	if cfg.Chunker != "" {
+		_, err := chunker.FromString(&bytes.Buffer{}, cfg.Chunker)
+		if err != nil {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid chunker %q: %v", cfg.Chunker, err)
+		}
+	}
+
+	if cfg.Hash != "" {
+		_, err := ParseHashFunction(cfg.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := validateAddOptions(cfg.unixfsAddOptions())
+	if err != nil {
+		return err
+	}
+
+	if cfg.MaxConcurrency < 0 {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "max concurrency must not be negative: %d", cfg.MaxConcurrency)
+	}
+
+	return nil
+}
+
+// Validate returns an error if any of the values in the config is invalid.
+func (cfg EmbeddedConfig) Validate() error {
+	switch cfg.Datastore {
+	case "", DatastoreFlatfs, DatastoreBadger:
+		if cfg.RepoPath == "" {
+			return errors.Wrap(errdefs.ErrInvalidArgument, "embedded ipfs node must have a repo path")
+		}
+	case DatastoreMemory:
+	default:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "unknown datastore %q", cfg.Datastore)
+	}
+
+	if cfg.Bootstrap != nil {
+		for _, s := range *cfg.Bootstrap {
+			_, err := ma.NewMultiaddr(s)
+			if err != nil {
+				return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid bootstrap address %q: %v", s, err)
+			}
+		}
+	}
+
+	for _, s := range cfg.SwarmAddresses {
+		_, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid swarm address %q: %v", s, err)
+		}
+	}
+
+	return nil
+}
+
+// NewCoreAPI returns a client of the IPFS API configured by cfg, or the API of
+// an embedded IPFS node. The embedded node runs until ctx is canceled.
+func (cfg Config) NewCoreAPI(ctx context.Context) (iface.CoreAPI, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Embedded != nil {
+		return newEmbeddedCoreAPI(ctx, *cfg.Embedded, cfg.Offline)
+	}
+
+	var addr ma.Multiaddr
+	if cfg.Address != "" {
+		addr, err = apiAddr(cfg.Address)
+	} else {
+		ipfsPath := cfg.IpfsPath
+		if ipfsPath == "" {
+			ipfsPath = httpapi.DefaultPathRoot
+		}
+		addr, err = httpapi.ApiAddr(ipfsPath)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get ipfs api address")
+	}
+
+	network, dialAddr, err := manet.DialArgs(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get dial args of %q", addr)
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.Timeout)}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: time.Duration(cfg.Timeout),
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, dialAddr)
+		},
+	}
+
+	// Requests over a unix socket still need a host for their URLs, so any
+	// host is used and the transport always dials the socket.
+	host := dialAddr
+	if network == "unix" {
+		host = "ipfs"
+	}
+
+	api, err := httpapi.NewURLApiWithClient(host, &http.Client{Transport: transport})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ipfs client")
+	}
+
+	for k, v := range cfg.Headers {
+		api.Headers.Set(k, v)
+	}
+
+	return api, nil
+}
+
+// unixfsAddOptions returns the options content is added to IPFS with. Leaves
+// are never added as raw blocks, which is the default for CIDv1, as a raw
+// block has no digest that containerd supports.
+func (cfg Config) unixfsAddOptions() []options.UnixfsAddOption {
+	opts := []options.UnixfsAddOption{options.Unixfs.RawLeaves(false)}
+	if mhType, ok := multihash.Names[cfg.Hash]; ok {
+		opts = append(opts, options.Unixfs.Hash(mhType))
+	}
+	if cfg.Chunker != "" {
+		opts = append(opts, options.Unixfs.Chunker(cfg.Chunker))
+	}
+	return opts
+}
+
+// validateAddOptions returns an error if content added with opts may get CIDs
+// whose digests containerd does not support. containerd only supports sha256
+// and sha512 digests, which are the digests of the CIDv0 and the sha2-512
+// CIDv1 of UnixFS nodes, so raw leaves are not supported either.
+func validateAddOptions(opts []options.UnixfsAddOption) error {
+	settings, _, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid add options: %v", err)
+	}
+
+	switch settings.MhType {
+	case multihash.SHA2_256, multihash.SHA2_512:
+	default:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "hash function %s is not supported, only sha2-256 and sha2-512 are", multihash.Codes[settings.MhType])
+	}
+
+	if settings.RawLeaves {
+		return errors.Wrap(errdefs.ErrInvalidArgument, "raw leaves are not supported")
+	}
+
+	return nil
+}
+
+func apiAddr(s string) (ma.Multiaddr, error) {
+	addr, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid address %q: %v", s, err)
+	}
+
+	network, _, err := manet.DialArgs(addr)
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid address %q: %v", s, err)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return addr, nil
+	default:
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "address %q is neither tcp nor a unix socket", s)
+	}
+}
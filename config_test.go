@@ -0,0 +1,183 @@
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, Config{}.Validate())
+
+	require.NoError(t, Config{
+		Address:        "/ip4/127.0.0.1/tcp/5001",
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		Timeout:        Duration(time.Minute),
+		ProbeTimeout:   Duration(time.Second),
+		Offline:        true,
+		PinMode:        PinDirect,
+		Chunker:        "rabin-262144-524288-1048576",
+		MaxConcurrency: 4,
+	}.Validate())
+
+	require.NoError(t, Config{Address: "/unix/run/ipfs.sock"}.Validate())
+
+	require.NoError(t, Config{Embedded: &EmbeddedConfig{RepoPath: "/var/lib/ipcs/ipfs"}}.Validate())
+
+	require.NoError(t, Config{Embedded: &EmbeddedConfig{
+		Bootstrap:      &[]string{},
+		SwarmAddresses: []string{"/ip4/127.0.0.1/tcp/0"},
+		Datastore:      DatastoreMemory,
+	}}.Validate())
+
+	for _, cfg := range []Config{
+		{Address: "127.0.0.1:5001"},
+		{Address: "/ip4/127.0.0.1/udp/5001"},
+		{Headers: map[string]string{"": "value"}},
+		{Timeout: Duration(-time.Second)},
+		{ProbeTimeout: Duration(-time.Second)},
+		{PinMode: "indirect"},
+		{Chunker: "size-foo"},
+		{Hash: "md4"},
+		{Hash: "blake2b-256"},
+		{MaxConcurrency: -1},
+		{Embedded: &EmbeddedConfig{}},
+		{Embedded: &EmbeddedConfig{RepoPath: "/var/lib/ipcs/ipfs", Datastore: "leveldb"}},
+		{Embedded: &EmbeddedConfig{Datastore: DatastoreMemory, Bootstrap: &[]string{"ipfs.io"}}},
+		{Embedded: &EmbeddedConfig{Datastore: DatastoreMemory, SwarmAddresses: []string{"0.0.0.0:4001"}}},
+		{Address: "/ip4/127.0.0.1/tcp/5001", Embedded: &EmbeddedConfig{Datastore: DatastoreMemory}},
+	} {
+		err := cfg.Validate()
+		require.True(t, errdefs.IsInvalidArgument(err), "%+v: %v", cfg, err)
+	}
+}
+
+func TestDurationUnmarshalText(t *testing.T) {
+	var d Duration
+	require.NoError(t, d.UnmarshalText([]byte("1m30s")))
+	require.Equal(t, Duration(90*time.Second), d)
+
+	text, err := d.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, "1m30s", string(text))
+
+	require.Error(t, d.UnmarshalText([]byte("soon")))
+}
+
+func TestNewCoreAPIUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "api.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	requests := make(chan *http.Request, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Keys":{}}`))
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	api, err := Config{
+		Address: "/unix" + sock,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Timeout: Duration(10 * time.Second),
+	}.NewCoreAPI(context.Background())
+	require.NoError(t, err)
+
+	pins, err := api.Pin().Ls(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, pins)
+
+	r := <-requests
+	require.Equal(t, "/api/v0/pin/ls", r.URL.Path)
+	require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+}
+
+func TestStoreConfig(t *testing.T) {
+	ctx := context.Background()
+
+	cs, err := NewContentStoreFromBackend(newTestBackend(), WithConfig(Config{
+		Chunker: "size-1024",
+	}))
+	require.NoError(t, err)
+
+	data := randomData(t, 4096)
+
+	w, err := cs.Writer(ctx, content.WithRef("config"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx, int64(len(data)), ""))
+
+	c, err := digestconv.DigestToCid(w.Digest())
+	require.NoError(t, err)
+
+	// The root links to 4 leaves of 1024 bytes each.
+	nd, err := cs.(*store).backend.Dag().Get(ctx, c)
+	require.NoError(t, err)
+	require.Len(t, nd.Links(), 4)
+	for _, l := range nd.Links() {
+		require.Equal(t, uint64(cid.DagProtobuf), l.Cid.Type())
+	}
+
+	p, err := content.ReadBlob(ctx, cs, ocispec.Descriptor{Digest: w.Digest()})
+	require.NoError(t, err)
+	require.Equal(t, data, p)
+
+	// Content hashed with sha2-512 gets sha512 digests, and its leaves are
+	// UnixFS nodes rather than the raw blocks of other CIDv1.
+	cs, err = NewContentStoreFromBackend(newTestBackend(), WithConfig(Config{
+		Chunker: "size-1024",
+		Hash:    "sha2-512",
+	}))
+	require.NoError(t, err)
+
+	w, err = cs.Writer(ctx, content.WithRef("config"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx, int64(len(data)), ""))
+	require.Equal(t, digest.SHA512, w.Digest().Algorithm())
+
+	c, err = digestconv.DigestToCid(w.Digest())
+	require.NoError(t, err)
+
+	nd, err = cs.(*store).backend.Dag().Get(ctx, c)
+	require.NoError(t, err)
+	require.Len(t, nd.Links(), 4)
+	for _, l := range nd.Links() {
+		require.Equal(t, uint64(cid.DagProtobuf), l.Cid.Type())
+	}
+
+	p, err = content.ReadBlob(ctx, cs, ocispec.Descriptor{Digest: w.Digest()})
+	require.NoError(t, err)
+	require.Equal(t, data, p)
+
+	// Content must get CIDs whose digests containerd supports.
+	for _, cfg := range []Config{{Hash: "blake2b-256"}, {Hash: "sha3-256"}} {
+		_, err = NewContentStoreFromBackend(newTestBackend(), WithConfig(cfg))
+		require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+	}
+}
@@ -4,49 +4,330 @@ import (
 	"archive/tar"
 	"context"
 	"encoding/json"
-	"io"
-	"io/ioutil"
 	"log"
-	"os"
+	"sync"
 
-	"github.com/containerd/containerd/archive"
-	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
 	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
-	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
+// uploadConcurrency is the default number of blobs of an image that are
+// copied to IPFS in parallel.
+const uploadConcurrency = 3
+
 // Converter converts OCI images to p2p distributed images via IPFS.
 type Converter interface {
 	Convert(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error)
 }
 
 type converter struct {
-	api      iface.CoreAPI
+	backend  Backend
 	provider content.Provider
+	addOpts  []options.UnixfsAddOption
+	pinMode  PinMode
+
+	// platform selects the manifests of an index that are converted.
+	platform platforms.MatchComparer
+
+	// concurrency is the number of blobs copied to IPFS in parallel.
+	concurrency int
+
+	// cache holds the blobs converted before, unless force is set to convert
+	// them again anyway.
+	cache *ConversionCache
+	force bool
+
+	// annotate converts images in annotation mode, keeping their digests.
+	annotate bool
+
+	// unixfsLayers converts layers to file-granular layers.
+	unixfsLayers bool
+
+	// sourceRef is the reference of the image converted, which is recorded
+	// in the annotations of the converted image.
+	sourceRef string
+
+	// added holds the blobs pinned by a conversion in progress, which are
+	// unpinned again if it fails.
+	added *addedBlobs
+}
+
+// addedBlobs are the blobs a conversion has added to IPFS and pinned.
+type addedBlobs struct {
+	mu    sync.Mutex
+	paths []path.Resolved
+
+	// pinned are the CIDs that were already pinned when the conversion
+	// started, which are shared with other content and must stay pinned.
+	pinned map[cid.Cid]bool
+}
+
+// ConverterOpt configures a converter.
+type ConverterOpt func(*converter)
+
+// WithConverterConfig adds content with the chunker and hash function of cfg,
+// pins it with its pin mode, and copies at most its MaxConcurrency blobs in
+// parallel. cfg must be valid.
+func WithConverterConfig(cfg Config) ConverterOpt {
+	return func(c *converter) {
+		c.addOpts = append(c.addOpts, cfg.unixfsAddOptions()...)
+		c.pinMode = cfg.PinMode
+		if cfg.MaxConcurrency > 0 {
+			c.concurrency = cfg.MaxConcurrency
+		}
+	}
+}
+
+// WithChunker adds content split by chunker, e.g. size-262144 or
+// rabin-262144-524288-1048576, instead of fixed chunks of 256KiB.
+func WithChunker(chunker string) ConverterOpt {
+	return func(c *converter) {
+		c.addOpts = append(c.addOpts, options.Unixfs.Chunker(chunker))
+	}
+}
+
+// WithHashFunction adds content hashed with the multihash function mhType,
+// sha2-256 or sha2-512, as containerd only supports sha256 and sha512 digests.
+// Content hashed with sha2-512 is added as CIDv1.
+func WithHashFunction(mhType uint64) ConverterOpt {
+	return func(c *converter) {
+		c.addOpts = append(c.addOpts, options.Unixfs.Hash(mhType))
+	}
+}
+
+// WithLayout adds content as DAGs of layout, balanced or trickle.
+func WithLayout(layout options.Layout) ConverterOpt {
+	return func(c *converter) {
+		c.addOpts = append(c.addOpts, options.Unixfs.Layout(layout))
+	}
+}
+
+// ParseChunkingOpts returns the options that add content with the chunker,
+// hash function and layout named chunker, hash and layout, e.g. by flags,
+// leaving out the ones that are empty.
+func ParseChunkingOpts(chunker, hash, layout string) ([]ConverterOpt, error) {
+	var opts []ConverterOpt
+	if chunker != "" {
+		opts = append(opts, WithChunker(chunker))
+	}
+	if hash != "" {
+		mhType, err := ParseHashFunction(hash)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithHashFunction(mhType))
+	}
+	if layout != "" {
+		l, err := ParseLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithLayout(l))
+	}
+	return opts, nil
+}
+
+// WithMaxConcurrentUploads copies at most n blobs of an image to IPFS in
+// parallel.
+func WithMaxConcurrentUploads(n int) ConverterOpt {
+	return func(c *converter) {
+		if n > 0 {
+			c.concurrency = n
+		}
+	}
+}
+
+// WithPlatforms only converts the manifests of an index for the platforms
+// matched by platform. Every platform is converted by default.
+func WithPlatforms(platform platforms.MatchComparer) ConverterOpt {
+	return func(c *converter) {
+		c.platform = platform
+	}
+}
+
+// WithConversionCache skips copying the blobs to IPFS that cc has recorded as
+// converted before with the same options, as long as their content is still
+// in IPFS.
+func WithConversionCache(cc *ConversionCache) ConverterOpt {
+	return func(c *converter) {
+		c.cache = cc
+	}
+}
+
+// WithForce copies every blob to IPFS even if the conversion cache has it.
+func WithForce() ConverterOpt {
+	return func(c *converter) {
+		c.force = true
+	}
+}
+
+// WithSourceRef records ref as the reference of the image converted in the
+// annotations of the converted image.
+func WithSourceRef(ref string) ConverterOpt {
+	return func(c *converter) {
+		c.sourceRef = ref
+	}
 }
 
-// NewConverter returns a new image manifest converter.
-func NewConverter(api iface.CoreAPI, provider content.Provider) Converter {
-	return &converter{
-		api:      api,
-		provider: provider,
+// WithUnixfsLayers converts layers to file-granular layers of media type
+// MediaTypeUnixfsLayer, whose files are added to IPFS individually so that they
+// are deduplicated across layers. It is ignored in annotation mode, which keeps
+// layers as they are.
+func WithUnixfsLayers() ConverterOpt {
+	return func(c *converter) {
+		c.unixfsLayers = true
 	}
 }
 
-// Convert converts a manifest specified by its descriptor to a new manifest
-// where every descriptor (manifest config and layers) is modified to point to
-// the root IPLD node of the respective content added to IPFS.
+// WithAnnotationMode converts images without changing them, so that they keep
+// their digests. The CIDs of their blobs are recorded in a CID index annotated
+// on the converted descriptor instead, which ipcs uses to resolve the digests
+// when the image is fetched.
+func WithAnnotationMode() ConverterOpt {
+	return func(c *converter) {
+		c.annotate = true
+	}
+}
+
+// NewConverter returns a new image converter.
+func NewConverter(backend Backend, provider content.Provider, opts ...ConverterOpt) Converter {
+	c := &converter{
+		backend:     backend,
+		provider:    provider,
+		platform:    platforms.All,
+		concurrency: uploadConcurrency,
+
+		// Leaves are never added as raw blocks, which is the default for
+		// CIDv1, as a raw block has no digest that containerd supports.
+		addOpts: []options.UnixfsAddOption{options.Unixfs.RawLeaves(false)},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Convert converts an image specified by its descriptor to a p2p image added
+// to IPFS. Manifests are converted by convertManifest, and indexes or manifest
+// lists by converting the manifests of the selected platforms into a new
+// index. In annotation mode, images are converted by convertAnnotated. The
+// blobs pinned by a conversion that fails are unpinned again, unless they were
+// already pinned before it started.
 func (c *converter) Convert(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
-	mfst, err := images.Manifest(ctx, c.provider, desc, platforms.Default())
+	err := validateAddOptions(c.addOpts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	conv := *c
+	conv.added, err = c.newAddedBlobs(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	converted, err := conv.convert(ctx, desc)
+	if err != nil {
+		conv.unpinAdded()
+		return ocispec.Descriptor{}, err
+	}
+
+	return converted, nil
+}
+
+func (c *converter) convert(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if c.annotate {
+		return c.convertAnnotated(ctx, desc)
+	}
+
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		return c.convertIndex(ctx, desc)
+	default:
+		return c.convertManifest(ctx, desc)
+	}
+}
+
+// convertIndex converts the manifests of an index or manifest list specified
+// by its descriptor for the selected platforms, and adds a new index of the
+// converted manifests that keeps their platforms.
+func (c *converter) convertIndex(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	p, err := content.ReadBlob(ctx, c.provider, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to get index")
+	}
+
+	var idx ocispec.Index
+	err = json.Unmarshal(p, &idx)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to unmarshal index")
+	}
+
+	var manifests []ocispec.Descriptor
+	for _, mfst := range idx.Manifests {
+		if mfst.Platform != nil && !c.platform.Match(*mfst.Platform) {
+			continue
+		}
+
+		converted, err := c.convert(ctx, mfst)
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to convert manifest %q", mfst.Digest)
+		}
+		converted.Platform = mfst.Platform
+		converted.Annotations = mfst.Annotations
+
+		manifests = append(manifests, converted)
+	}
+
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "no manifest in %q for the selected platforms", desc.Digest)
+	}
+
+	annotations, err := c.imageAnnotations(idx.Annotations, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	idxJSON, err := json.MarshalIndent(ocispec.Index{
+		Versioned:   idx.Versioned,
+		Manifests:   manifests,
+		Annotations: annotations,
+	}, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal index JSON")
+	}
+
+	idxDigest, err := c.addFile(ctx, files.NewBytesFile(idxJSON))
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to upload index")
+	}
+	log.Printf("Converted Index [%d] %s:\n%s", len(idxJSON), idxDigest, idxJSON)
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    idxDigest,
+		Size:      int64(len(idxJSON)),
+	}, nil
+}
+
+// convertManifest converts a manifest specified by its descriptor to a new
+// manifest where every descriptor (manifest config and layers) is modified to
+// point to the root IPLD node of the respective content added to IPFS. The new
+// manifest and its descriptors are annotated with what they were converted
+// from.
+func (c *converter) convertManifest(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	mfst, err := images.Manifest(ctx, c.provider, desc, c.platform)
 	if err != nil {
 		return ocispec.Descriptor{}, errors.Wrap(err, "failed to get manifest")
 	}
@@ -63,16 +344,49 @@ func (c *converter) Convert(ctx context.Context, desc ocispec.Descriptor) (ocisp
 	}
 	log.Printf("Original Manifest Config [%d] %s:\n%s", len(origMfstConfigJSON), mfst.Config.Digest, origMfstConfigJSON)
 
-	mfst.Config.Digest, err = copyFile(ctx, c.api, c.provider, mfst.Config)
+	// File-granular layers are converted by copyLayers instead.
+	blobs := append([]ocispec.Descriptor{mfst.Config}, mfst.Layers...)
+	if c.unixfsLayers {
+		blobs = blobs[:1]
+	}
+
+	dgsts, err := c.copyFiles(ctx, blobs)
 	if err != nil {
-		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to upload manifest config blob %q", mfst.Config.Digest)
+		return ocispec.Descriptor{}, err
 	}
 
+	var unixfsLayers []ocispec.Descriptor
+	if c.unixfsLayers {
+		unixfsLayers, err = c.copyLayers(ctx, mfst.Layers)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	mfst.Config.Annotations, err = c.blobAnnotations(mfst.Config.Annotations, mfst.Config.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	mfst.Config.Digest = dgsts[0]
+
 	for i, layer := range mfst.Layers {
-		mfst.Layers[i].Digest, err = copyFile(ctx, c.api, c.provider, layer)
+		converted := layer
+		if c.unixfsLayers {
+			converted = unixfsLayers[i]
+		} else {
+			converted.Digest = dgsts[i+1]
+		}
+
+		converted.Annotations, err = c.blobAnnotations(layer.Annotations, layer.Digest)
 		if err != nil {
-			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to upload blob %q", layer.Digest)
+			return ocispec.Descriptor{}, err
 		}
+		mfst.Layers[i] = converted
+	}
+
+	mfst.Annotations, err = c.imageAnnotations(mfst.Annotations, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
 	}
 
 	mfstJSON, err := json.MarshalIndent(mfst, "", "   ")
@@ -80,7 +394,7 @@ func (c *converter) Convert(ctx context.Context, desc ocispec.Descriptor) (ocisp
 		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal manifest JSON")
 	}
 
-	mfstDigest, err := addFile(ctx, c.api, files.NewBytesFile(mfstJSON))
+	mfstDigest, err := c.addFile(ctx, files.NewBytesFile(mfstJSON))
 	if err != nil {
 		return ocispec.Descriptor{}, errors.Wrap(err, "failed to upload manifest")
 	}
@@ -93,111 +407,197 @@ func (c *converter) Convert(ctx context.Context, desc ocispec.Descriptor) (ocisp
 	}, nil
 }
 
-// copyFile copies content specified by its descriptor from a provider to IPFS.
-func copyFile(ctx context.Context, api iface.CoreAPI, provider content.Provider, desc ocispec.Descriptor) (digest.Digest, error) {
-	ra, err := provider.ReaderAt(ctx, desc)
+// copyFiles copies the content specified by descs from the provider to IPFS,
+// at most c.concurrency in parallel, and returns their digests in the order of
+// descs. The first failure cancels the copies still in progress.
+func (c *converter) copyFiles(ctx context.Context, descs []ocispec.Descriptor) ([]digest.Digest, error) {
+	dgsts := make([]digest.Digest, len(descs))
+	err := c.forEach(ctx, len(descs), func(ctx context.Context, i int) error {
+		dgst, err := c.copyFile(ctx, descs[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to upload blob %q", descs[i].Digest)
+		}
+
+		dgsts[i] = dgst
+		return nil
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create reader")
+		return nil, err
 	}
-	defer ra.Close()
 
-	return addFile(ctx, api, files.NewReaderFile(content.NewReader(ra)))
+	return dgsts, nil
 }
 
-// addFile adds a file to IPFS. In the case of layers, these are the layer
-// tarballs with an optional "+gzip" compression.
-func addFile(ctx context.Context, api iface.CoreAPI, n files.Node) (digest.Digest, error) {
-	p, err := api.Unixfs().Add(ctx, n, options.Unixfs.Pin(true))
+// copyLayers converts the layers specified by descs to file-granular layers,
+// at most c.concurrency in parallel, and returns their descriptors in the
+// order of descs.
+func (c *converter) copyLayers(ctx context.Context, descs []ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	layers := make([]ocispec.Descriptor, len(descs))
+	err := c.forEach(ctx, len(descs), func(ctx context.Context, i int) error {
+		layer, err := c.copyLayer(ctx, descs[i])
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert layer %q", descs[i].Digest)
+		}
+
+		layers[i] = layer
+		return nil
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "failed to put blob to ipfs")
+		return nil, err
 	}
 
-	dgst, err := digestconv.CidToDigest(p.Cid())
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to convert cid %q to digest", p.Cid())
+	return layers, nil
+}
+
+// forEach calls fn with every index below n, at most c.concurrency in
+// parallel. The first failure cancels the calls still in progress.
+func (c *converter) forEach(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	sem := semaphore.NewWeighted(int64(c.concurrency))
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	var err error
+	for i := 0; i < n; i++ {
+		// Acquire only fails once egCtx is done, either by the caller or by a
+		// failed call.
+		err = sem.Acquire(egCtx, 1)
+		if err != nil {
+			break
+		}
+
+		i := i
+		eg.Go(func() error {
+			defer sem.Release(1)
+			return fn(egCtx, i)
+		})
 	}
 
-	return dgst, nil
+	// The calls still in progress are waited for, so that none outlives the
+	// conversion.
+	egErr := eg.Wait()
+	if egErr != nil {
+		return egErr
+	}
+	return err
 }
 
-// copyLayer decompresses and untars the layer into a temporary directory and
-// adds the directory recursively into IPFS as individual files. This can
-// potentially increase the deduplication at a per-file basis, but early tests
-// show that similar images often don't have many byte-for-byte equivalent
-// files.
-//
-// Another disadvantage is that the layers are now uncompressed so layer sizes
-// and number of IPLD blocks increase roughly 10x. Perhaps every individual
-// file can be gzipped to reduce this.
-//
-// IPFS also doesn't support uid/gid, modtime, xattrs, and other file system
-// features to have a working container rootfs atm, so this is just a POC.
-func copyLayer(ctx context.Context, api iface.CoreAPI, provider content.Provider, desc ocispec.Descriptor) (digest.Digest, error) {
-	ra, err := provider.ReaderAt(ctx, desc)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to create reader")
+// copyFile copies content specified by its descriptor from the provider to
+// IPFS, unless the conversion cache has it.
+func (c *converter) copyFile(ctx context.Context, desc ocispec.Descriptor) (digest.Digest, error) {
+	var key string
+	if c.cache != nil {
+		var err error
+		key, err = addOptionsKey(c.addOpts)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid add options")
+		}
+
+		if !c.force {
+			dgst, ok, err := c.cached(ctx, key, desc)
+			if err != nil || ok {
+				return dgst, err
+			}
+		}
 	}
-	defer ra.Close()
 
-	root, err := ioutil.TempDir("", "ipcs-root")
+	ra, err := c.provider.ReaderAt(ctx, desc)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create tmp root directory")
+		return "", errors.Wrap(err, "failed to create reader")
 	}
+	defer ra.Close()
 
-	isCompressed, err := images.IsCompressedDiff(ctx, desc.MediaType)
+	dgst, err := c.addFile(ctx, files.NewReaderFile(content.NewReader(ra)))
 	if err != nil {
-		return "", errors.Wrapf(err, "unsupported diff media type: %v", desc.MediaType)
+		return "", err
 	}
 
-	r := content.NewReader(ra)
-
-	if isCompressed {
-		ds, err := compression.DecompressStream(r)
+	if c.cache != nil {
+		err = c.cache.add(key, desc.Digest, conversion{Digest: dgst, Size: ra.Size()})
 		if err != nil {
-			return "", errors.Wrap(err, "failed to decompress stream")
+			return "", err
 		}
-		defer ds.Close()
-		r = ds
 	}
 
-	if _, err := archive.Apply(ctx, root, r, archive.WithFilter(RegularTypeFilter)); err != nil {
-		return "", errors.Wrapf(err, "failed to apply tar archive to directory %q", root)
+	return dgst, nil
+}
+
+// cached returns the digest the content specified by its descriptor was
+// converted to before, and whether it is still in IPFS. Cached content is
+// pinned again offline, which is cheap for content that is still pinned and
+// fails without fetching anything for content that is gone.
+func (c *converter) cached(ctx context.Context, key string, desc ocispec.Descriptor) (digest.Digest, bool, error) {
+	conv, ok, err := c.cache.lookup(key, desc.Digest)
+	if err != nil || !ok {
+		return "", false, err
 	}
 
-	// Read any trailing data
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		return "", errors.Wrap(err, "failed to discard trailing data after tar archive")
+	if desc.Size > 0 && desc.Size != conv.Size {
+		return "", false, nil
 	}
 
-	stat, err := os.Stat(root)
+	root, err := digestconv.DigestToCid(conv.Digest)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to stat root")
+		return "", false, errors.Wrapf(err, "failed to convert digest %q to cid", conv.Digest)
 	}
 
-	n, err := files.NewSerialFile(root, false, stat)
+	offline, err := c.backend.Offline()
 	if err != nil {
-		return "", errors.Wrap(err, "failed to create serial file out of root")
+		return "", false, errors.Wrap(err, "failed to create offline ipfs backend")
 	}
 
-	dir := files.NewSliceDirectory([]files.DirEntry{
-		files.FileEntry("", n),
-	})
+	ok, err = c.keepCached(ctx, offline, root)
+	if err != nil || !ok {
+		return "", false, err
+	}
 
-	var p path.Resolved
-	entries := dir.Entries()
-	for entries.Next() {
-		p, err = api.Unixfs().Add(ctx, entries.Node(), options.Unixfs.Pin(true))
-		if err != nil {
-			return "", errors.Wrapf(err, "failed to add node %q", entries.Name())
-		}
+	return conv.Digest, true, nil
+}
 
+// keepCached pins the cached content at root again with offline, or only gets
+// its root node if content is not pinned, and returns whether it is still in
+// IPFS.
+func (c *converter) keepCached(ctx context.Context, offline Backend, root cid.Cid) (bool, error) {
+	var err error
+	if c.pinMode == PinNone {
+		_, err = offline.Dag().Get(ctx, root)
+		err = ipfsError(err)
+	} else {
+		err = pinPath(ctx, offline, path.IpfsPath(root), c.pinMode)
+	}
+	switch {
+	case errdefs.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, errors.Wrapf(err, "failed to check cached conversion %q", root)
 	}
 
-	if entries.Err() != nil {
-		return "", entries.Err()
+	return true, nil
+}
+
+// addFile adds a file to IPFS. In the case of layers, these are the layer
+// tarballs with an optional "+gzip" compression.
+func (c *converter) addFile(ctx context.Context, n files.Node) (digest.Digest, error) {
+	// Recursive pins are made by the add itself, so that the content cannot be
+	// garbage collected before it is pinned.
+	recursive := c.pinMode == "" || c.pinMode == PinRecursive
+	opts := append([]options.UnixfsAddOption{options.Unixfs.Pin(recursive)}, c.addOpts...)
+
+	p, err := c.backend.Add(ctx, n, opts...)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to put blob to ipfs")
+	}
+
+	if !recursive {
+		err = pinPath(ctx, c.backend, p, c.pinMode)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	log.Printf("Added as %s", p.Cid())
+	if c.added != nil && c.pinMode != PinNone && !c.added.pinned[p.Cid()] {
+		c.added.mu.Lock()
+		c.added.paths = append(c.added.paths, p)
+		c.added.mu.Unlock()
+	}
 
 	dgst, err := digestconv.CidToDigest(p.Cid())
 	if err != nil {
@@ -207,6 +607,67 @@ func copyLayer(ctx context.Context, api iface.CoreAPI, provider content.Provider
 	return dgst, nil
 }
 
+// newAddedBlobs returns the blobs of a new conversion, which knows what was
+// pinned before it started, so that a failed conversion only unpins its own
+// pins.
+func (c *converter) newAddedBlobs(ctx context.Context) (*addedBlobs, error) {
+	if c.pinMode == PinNone {
+		return &addedBlobs{pinned: make(map[cid.Cid]bool)}, nil
+	}
+
+	pinned, err := pinnedCids(ctx, c.backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return &addedBlobs{pinned: pinned}, nil
+}
+
+// pinnedCids returns the CIDs that are pinned recursively or directly, which
+// are listed offline.
+func pinnedCids(ctx context.Context, backend Backend) (map[cid.Cid]bool, error) {
+	offline, err := backend.Offline()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create offline ipfs backend")
+	}
+
+	pinned := make(map[cid.Cid]bool)
+	for _, pinType := range []options.PinLsOption{options.Pin.Type.Recursive(), options.Pin.Type.Direct()} {
+		pins, err := offline.Pins(ctx, pinType)
+		if err != nil {
+			return nil, errors.Wrap(ipfsError(err), "failed to list ipfs pins")
+		}
+
+		for _, pin := range pins {
+			pinned[pin.Path().Cid()] = true
+		}
+	}
+
+	return pinned, nil
+}
+
+// unpinAdded unpins the blobs added by a failed conversion, so that they are
+// left to be garbage collected by IPFS. They are unpinned even if the
+// conversion was canceled.
+func (c *converter) unpinAdded() {
+	c.added.mu.Lock()
+	defer c.added.mu.Unlock()
+
+	unpinned := make(map[cid.Cid]bool)
+	for _, p := range c.added.paths {
+		if unpinned[p.Cid()] {
+			continue
+		}
+		unpinned[p.Cid()] = true
+
+		err := c.backend.Unpin(context.Background(), p)
+		if err != nil && !errdefs.IsNotFound(ipfsError(err)) {
+			log.Printf("Failed to unpin %s of failed conversion: %v", p, err)
+		}
+	}
+	c.added.paths = nil
+}
+
 // RegularTypeFilter filters out tar headers that are not regular, symlinks,
 // or directories.
 //
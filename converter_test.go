@@ -0,0 +1,696 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage is an image written by writeTestImage.
+type testImage struct {
+	provider content.Provider
+	platform ocispec.Platform
+	manifest ocispec.Descriptor
+	config   []byte
+	layers   [][]byte
+
+	// blobs are the descriptors of the manifest, the config and the layers.
+	blobs []ocispec.Descriptor
+
+	// diffIDs are the diff IDs of the layers, which are only known for
+	// images written with withTestRootFS.
+	diffIDs []digest.Digest
+
+	// write writes another blob where the image was written.
+	write func(t *testing.T, mediaType string, p []byte) ocispec.Descriptor
+}
+
+// testImageOpt changes how writeTestImage writes an image.
+type testImageOpt func(*testImageOpts)
+
+type testImageOpts struct {
+	ctx     context.Context
+	backend Backend
+	rootFS  bool
+}
+
+// withTestContext writes the blobs of the image with ctx, such as into a
+// namespace.
+func withTestContext(ctx context.Context) testImageOpt {
+	return func(o *testImageOpts) {
+		o.ctx = ctx
+	}
+}
+
+// withTestBackend adds the blobs of the image to backend without pinning them
+// instead, so that it is a p2p image whose digests are those of its CIDs.
+func withTestBackend(backend Backend) testImageOpt {
+	return func(o *testImageOpts) {
+		o.backend = backend
+	}
+}
+
+// withTestRootFS records the diff IDs of the layers in the config of the
+// image, for which the layers must be gzipped tar streams.
+func withTestRootFS() testImageOpt {
+	return func(o *testImageOpts) {
+		o.rootFS = true
+	}
+}
+
+func newTestImage(t *testing.T, root string, layers ...[]byte) testImage {
+	cs, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	return writeTestImage(t, cs, platforms.DefaultSpec(), layers)
+}
+
+// writeTestImage writes an image for platform with layers to cs, or wherever
+// opts write it instead.
+func writeTestImage(t *testing.T, cs content.Store, platform ocispec.Platform, layers [][]byte, opts ...testImageOpt) testImage {
+	o := testImageOpts{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	img := testImage{
+		provider: cs,
+		platform: platform,
+		layers:   layers,
+		write: func(t *testing.T, mediaType string, p []byte) ocispec.Descriptor {
+			return writeTestBlobContext(o.ctx, t, cs, mediaType, p)
+		},
+	}
+	if o.backend != nil {
+		img.provider = newStore(o.backend)
+		img.write = func(t *testing.T, mediaType string, p []byte) ocispec.Descriptor {
+			return addTestP2PBlob(t, o.backend, mediaType, p)
+		}
+	}
+
+	var layerDescs []ocispec.Descriptor
+	for _, layer := range layers {
+		layerDescs = append(layerDescs, img.write(t, ocispec.MediaTypeImageLayerGzip, layer))
+
+		if o.rootFS {
+			zr, err := gzip.NewReader(bytes.NewReader(layer))
+			require.NoError(t, err)
+
+			diffID, err := digest.FromReader(zr)
+			require.NoError(t, err)
+			img.diffIDs = append(img.diffIDs, diffID)
+		}
+	}
+
+	config := ocispec.Image{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+	}
+	if o.rootFS {
+		config.RootFS = ocispec.RootFS{Type: "layers", DiffIDs: img.diffIDs}
+	}
+
+	var err error
+	img.config, err = json.Marshal(config)
+	require.NoError(t, err)
+
+	mfst := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    img.write(t, ocispec.MediaTypeImageConfig, img.config),
+		Layers:    layerDescs,
+	}
+
+	mfstJSON, err := json.Marshal(mfst)
+	require.NoError(t, err)
+
+	img.manifest = img.write(t, ocispec.MediaTypeImageManifest, mfstJSON)
+	img.blobs = append([]ocispec.Descriptor{img.manifest, mfst.Config}, layerDescs...)
+	return img
+}
+
+// writeTestIndex writes an index of the manifests of imgs for their platforms
+// where the first of them was written.
+func writeTestIndex(t *testing.T, imgs ...testImage) ocispec.Descriptor {
+	idx := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	for _, img := range imgs {
+		idx.Manifests = append(idx.Manifests, withPlatform(img.manifest, img.platform))
+	}
+
+	idxJSON, err := json.Marshal(idx)
+	require.NoError(t, err)
+
+	return imgs[0].write(t, ocispec.MediaTypeImageIndex, idxJSON)
+}
+
+func writeTestBlob(t *testing.T, cs content.Store, mediaType string, p []byte) ocispec.Descriptor {
+	return writeTestBlobContext(context.Background(), t, cs, mediaType, p)
+}
+
+// writeTestBlobContext is like writeTestBlob, except that the blob is written
+// with ctx, such as into a namespace.
+func writeTestBlobContext(ctx context.Context, t *testing.T, cs content.Store, mediaType string, p []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}
+	err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc)
+	require.NoError(t, err)
+	return desc
+}
+
+// addTestP2PBlob adds p to backend without pinning it, and returns its
+// descriptor with the digest of its CID.
+func addTestP2PBlob(t *testing.T, backend Backend, mediaType string, p []byte) ocispec.Descriptor {
+	path, err := backend.Add(context.Background(), files.NewBytesFile(p), options.Unixfs.Pin(false))
+	require.NoError(t, err)
+
+	dgst, err := digestconv.CidToDigest(path.Cid())
+	require.NoError(t, err)
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(p)),
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, root, randomData(t, 1<<20), randomData(t, 4096))
+
+	backend := NewMemoryBackend()
+	desc, err := NewConverter(backend, img.provider).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+	require.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+
+	// The converted image is read back from IPFS through the store.
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+
+	p, err := content.ReadBlob(ctx, cs, mfst.Config)
+	require.NoError(t, err)
+	require.Equal(t, img.config, p)
+
+	require.Len(t, mfst.Layers, len(img.layers))
+	for i, layer := range mfst.Layers {
+		require.Equal(t, ocispec.MediaTypeImageLayerGzip, layer.MediaType)
+
+		p, err := content.ReadBlob(ctx, cs, layer)
+		require.NoError(t, err)
+		require.Equal(t, img.layers[i], p)
+	}
+
+	// Everything converted is pinned recursively.
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, len(img.layers)+2)
+}
+
+func TestConvertWithConfig(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, root, randomData(t, 4096))
+
+	backend := NewMemoryBackend()
+	converter := NewConverter(backend, img.provider, WithConverterConfig(Config{
+		PinMode: PinDirect,
+		Chunker: "size-1024",
+	}))
+
+	desc, err := converter.Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+
+	c, err := digestconv.DigestToCid(mfst.Layers[0].Digest)
+	require.NoError(t, err)
+
+	nd, err := backend.Dag().Get(ctx, c)
+	require.NoError(t, err)
+	require.Len(t, nd.Links(), 4)
+
+	// Only the roots of the converted content are pinned.
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Empty(t, pins)
+
+	pins, err = backend.Pins(ctx, options.Pin.Type.Direct())
+	require.NoError(t, err)
+	require.Len(t, pins, 3)
+}
+
+func TestConvertChunking(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, root, randomData(t, 8192))
+
+	mhType, err := ParseHashFunction("sha2-512")
+	require.NoError(t, err)
+
+	layout, err := ParseLayout("trickle")
+	require.NoError(t, err)
+
+	backend := NewMemoryBackend()
+	converter := NewConverter(backend, img.provider,
+		WithChunker("size-1024"),
+		WithHashFunction(mhType),
+		WithLayout(layout),
+	)
+
+	desc, err := converter.Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+
+	// The manifest records how its layers were added.
+	layer := mfst.Layers[0]
+	require.Equal(t, "size-1024", layer.Annotations[AnnotationChunker])
+	require.Equal(t, "1", layer.Annotations[AnnotationCIDVersion])
+	require.Equal(t, "false", layer.Annotations[AnnotationRawLeaves])
+	require.Equal(t, "sha2-512", layer.Annotations[AnnotationHash])
+	require.Equal(t, "trickle", layer.Annotations[AnnotationLayout])
+	require.Equal(t, "trickle", mfst.Annotations[AnnotationLayout])
+
+	// Its CIDv1 has a sha512 digest, which containerd supports.
+	require.NoError(t, layer.Digest.Validate())
+	require.Equal(t, digest.SHA512, layer.Digest.Algorithm())
+
+	c, err := digestconv.DigestToCid(layer.Digest)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Version())
+	require.Equal(t, mhType, c.Prefix().MhType)
+
+	nd, err := backend.Dag().Get(ctx, c)
+	require.NoError(t, err)
+	for _, l := range nd.Links() {
+		require.Equal(t, uint64(cid.DagProtobuf), l.Cid.Type())
+	}
+
+	p, err := content.ReadBlob(ctx, cs, layer)
+	require.NoError(t, err)
+	require.Equal(t, img.layers[0], p)
+
+	// The layout changes the DAG of the layer, and so its digest.
+	desc, err = NewConverter(backend, img.provider,
+		WithChunker("size-1024"),
+		WithHashFunction(mhType),
+	).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	balanced, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+	require.Equal(t, "balanced", balanced.Layers[0].Annotations[AnnotationLayout])
+	require.NotEqual(t, layer.Digest, balanced.Layers[0].Digest)
+
+	_, err = ParseLayout("pyramid")
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+
+	_, err = ParseHashFunction("md4")
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+
+	// CIDs whose digests containerd does not support are rejected.
+	blake2b, err := ParseHashFunction("blake2b-256")
+	require.NoError(t, err)
+
+	for _, opts := range [][]ConverterOpt{
+		{WithHashFunction(blake2b)},
+		{WithConverterConfig(Config{Hash: "sha3-256"})},
+	} {
+		_, err = NewConverter(backend, img.provider, opts...).Convert(ctx, img.manifest)
+		require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+	}
+}
+
+func TestConvertIndex(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	provider, err := local.NewStore(root)
+	require.NoError(t, err)
+
+	var (
+		amd64 = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+		arm64 = ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+		imgs  = map[string]testImage{
+			"amd64": writeTestImage(t, provider, amd64, [][]byte{randomData(t, 4096)}),
+			"arm64": writeTestImage(t, provider, arm64, [][]byte{randomData(t, 4096)}),
+		}
+	)
+
+	idxJSON, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{
+			withPlatform(imgs["amd64"].manifest, amd64),
+			withPlatform(imgs["arm64"].manifest, arm64),
+		},
+	})
+	require.NoError(t, err)
+	idx := writeTestBlob(t, provider, images.MediaTypeDockerSchema2ManifestList, idxJSON)
+
+	for _, tc := range []struct {
+		opts      []ConverterOpt
+		platforms []ocispec.Platform
+	}{
+		{nil, []ocispec.Platform{amd64, arm64}},
+		{[]ConverterOpt{WithPlatforms(platforms.Only(arm64))}, []ocispec.Platform{arm64}},
+	} {
+		backend := NewMemoryBackend()
+		desc, err := NewConverter(backend, provider, tc.opts...).Convert(ctx, idx)
+		require.NoError(t, err)
+		require.Equal(t, ocispec.MediaTypeImageIndex, desc.MediaType)
+
+		cs, err := NewContentStoreFromBackend(backend)
+		require.NoError(t, err)
+
+		// The converted index keeps the platforms of its manifests.
+		actual, err := images.Platforms(ctx, cs, desc)
+		require.NoError(t, err)
+		require.Equal(t, tc.platforms, actual)
+
+		for _, platform := range tc.platforms {
+			mfst, err := images.Manifest(ctx, cs, desc, platforms.Only(platform))
+			require.NoError(t, err)
+
+			p, err := content.ReadBlob(ctx, cs, mfst.Layers[0])
+			require.NoError(t, err)
+			require.Equal(t, imgs[platform.Architecture].layers[0], p)
+		}
+	}
+
+	// Converting no manifest at all is an error.
+	_, err = NewConverter(NewMemoryBackend(), provider, WithPlatforms(platforms.Only(ocispec.Platform{OS: "windows", Architecture: "amd64"}))).Convert(ctx, idx)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+}
+
+func withPlatform(desc ocispec.Descriptor, platform ocispec.Platform) ocispec.Descriptor {
+	desc.Platform = &platform
+	return desc
+}
+
+// testProvider tracks how many blobs are read from it in parallel, and fails
+// to read the blob with the digest fail.
+type testProvider struct {
+	content.Provider
+	fail digest.Digest
+
+	mu      sync.Mutex
+	opened  map[digest.Digest]int
+	reading int
+	max     int
+}
+
+func (p *testProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if desc.Digest == p.fail {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %v", desc.Digest)
+	}
+
+	ra, err := p.Provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.opened == nil {
+		p.opened = make(map[digest.Digest]int)
+	}
+	p.opened[desc.Digest]++
+	p.reading++
+	if p.reading > p.max {
+		p.max = p.reading
+	}
+	p.mu.Unlock()
+
+	// Give other blobs the time to be read in parallel.
+	time.Sleep(10 * time.Millisecond)
+	return &testReaderAt{ReaderAt: ra, p: p}, nil
+}
+
+// openCount returns how many times the blobs of descs were read.
+func (p *testProvider) openCount(descs []ocispec.Descriptor) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int
+	for _, desc := range descs {
+		n += p.opened[desc.Digest]
+	}
+	return n
+}
+
+func (p *testProvider) stats() (reading, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.reading, p.max
+}
+
+type testReaderAt struct {
+	content.ReaderAt
+	p *testProvider
+}
+
+func (ra *testReaderAt) Close() error {
+	ra.p.mu.Lock()
+	ra.p.reading--
+	ra.p.mu.Unlock()
+
+	return ra.ReaderAt.Close()
+}
+
+func TestConvertConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var layers [][]byte
+	for i := 0; i < 8; i++ {
+		layers = append(layers, randomData(t, 1024*(i+1)))
+	}
+	img := newTestImage(t, root, layers...)
+
+	provider := &testProvider{Provider: img.provider}
+	backend := NewMemoryBackend()
+	desc, err := NewConverter(backend, provider, WithMaxConcurrentUploads(2)).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	_, max := provider.stats()
+	require.Equal(t, 2, max)
+
+	// The layers keep their order.
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+	require.Len(t, mfst.Layers, len(layers))
+	for i, layer := range mfst.Layers {
+		p, err := content.ReadBlob(ctx, cs, layer)
+		require.NoError(t, err)
+		require.Equal(t, layers[i], p)
+	}
+
+	// A layer that fails stops the conversion, which waits for the uploads
+	// in progress.
+	mfst, err = images.Manifest(ctx, img.provider, img.manifest, platforms.Default())
+	require.NoError(t, err)
+
+	provider = &testProvider{Provider: img.provider, fail: mfst.Layers[3].Digest}
+	_, err = NewConverter(NewMemoryBackend(), provider, WithMaxConcurrentUploads(2)).Convert(ctx, img.manifest)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	reading, _ := provider.stats()
+	require.Zero(t, reading)
+}
+
+func TestConvertFailureUnpins(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var layers [][]byte
+	for i := 0; i < 4; i++ {
+		_, layer := newTestLayer(t, testEntry{
+			hdr:  tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("file%d", i), Mode: 0644},
+			data: randomData(t, 1024*(i+1)),
+		})
+		layers = append(layers, layer)
+	}
+	img := newTestImage(t, root, layers...)
+
+	mfst, err := images.Manifest(ctx, img.provider, img.manifest, platforms.Default())
+	require.NoError(t, err)
+
+	for _, opts := range [][]ConverterOpt{
+		nil,
+		{WithConverterConfig(Config{PinMode: PinDirect})},
+		{WithUnixfsLayers()},
+	} {
+		// The last layer fails after the blobs before it have been added.
+		provider := &testProvider{Provider: img.provider, fail: mfst.Layers[len(layers)-1].Digest}
+		backend := NewMemoryBackend()
+
+		opts = append(opts, WithMaxConcurrentUploads(2))
+		_, err = NewConverter(backend, provider, opts...).Convert(ctx, img.manifest)
+		require.True(t, errdefs.IsNotFound(err), "%v", err)
+		require.NotZero(t, provider.openCount(mfst.Layers[:len(layers)-1]))
+
+		for _, pinType := range []options.PinLsOption{options.Pin.Type.Recursive(), options.Pin.Type.Direct()} {
+			pins, err := backend.Pins(ctx, pinType)
+			require.NoError(t, err)
+			require.Empty(t, pins)
+		}
+	}
+}
+
+func TestConvertFailureKeepsSharedPins(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	shared, missing := randomData(t, 4096), randomData(t, 1024)
+	imgA := newTestImage(t, filepath.Join(root, "a"), shared)
+	imgB := newTestImage(t, filepath.Join(root, "b"), shared, missing)
+
+	mfst, err := images.Manifest(ctx, imgB.provider, imgB.manifest, platforms.Default())
+	require.NoError(t, err)
+
+	for _, opts := range [][]ConverterOpt{
+		nil,
+		{WithConverterConfig(Config{PinMode: PinDirect})},
+	} {
+		backend := NewMemoryBackend()
+
+		_, err = NewConverter(backend, imgA.provider, opts...).Convert(ctx, imgA.manifest)
+		require.NoError(t, err)
+
+		pinned := func() []iface.Pin {
+			var all []iface.Pin
+			for _, pinType := range []options.PinLsOption{options.Pin.Type.Recursive(), options.Pin.Type.Direct()} {
+				pins, err := backend.Pins(ctx, pinType)
+				require.NoError(t, err)
+				all = append(all, pins...)
+			}
+			return all
+		}
+		expected := pinned()
+
+		// Image B shares the layer of image A, and fails on its last layer,
+		// which leaves the pins of image A alone.
+		provider := &testProvider{Provider: imgB.provider, fail: mfst.Layers[1].Digest}
+		_, err = NewConverter(backend, provider, append(opts, WithMaxConcurrentUploads(1))...).Convert(ctx, imgB.manifest)
+		require.True(t, errdefs.IsNotFound(err), "%v", err)
+		require.NotZero(t, provider.openCount(mfst.Layers[:1]))
+		require.ElementsMatch(t, expected, pinned())
+	}
+}
+
+func TestConvertCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, filepath.Join(root, "content"), randomData(t, 4096), randomData(t, 1024))
+
+	mfst, err := images.Manifest(ctx, img.provider, img.manifest, platforms.Default())
+	require.NoError(t, err)
+	blobs := len(mfst.Layers)
+
+	cc, err := OpenConversionCache(filepath.Join(root, "cache.db"))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	backend := NewMemoryBackend()
+	convert := func(backend Backend, opts ...ConverterOpt) (ocispec.Descriptor, int) {
+		provider := &testProvider{Provider: img.provider}
+		desc, err := NewConverter(backend, provider, append(opts, WithConversionCache(cc))...).Convert(ctx, img.manifest)
+		require.NoError(t, err)
+		return desc, provider.openCount(mfst.Layers)
+	}
+
+	desc, opened := convert(backend)
+	require.Equal(t, blobs, opened)
+
+	// Converting again neither fetches nor adds any blob.
+	cached, opened := convert(backend)
+	require.Zero(t, opened)
+	require.Equal(t, desc, cached)
+
+	// The cache is only used for the same add options.
+	_, opened = convert(backend, WithConverterConfig(Config{Chunker: "size-1024"}))
+	require.Equal(t, blobs, opened)
+
+	// Forcing the conversion converts everything again.
+	_, opened = convert(backend, WithForce())
+	require.Equal(t, blobs, opened)
+
+	// Content that is no longer in IPFS is converted again.
+	other := NewMemoryBackend()
+	cached, opened = convert(other)
+	require.Equal(t, blobs, opened)
+	require.Equal(t, desc, cached)
+
+	pins, err := other.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, blobs+2)
+}
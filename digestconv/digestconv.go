@@ -2,6 +2,7 @@ package digestconv
 
 import (
 	"encoding/hex"
+	"strings"
 
 	cid "github.com/ipfs/go-cid"
 	multihash "github.com/multiformats/go-multihash"
@@ -9,25 +10,177 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// BLAKE2b is a blake2b digest with hex encoding. Its size is given by the
+	// length of the encoded digest, up to 64 bytes.
+	BLAKE2b digest.Algorithm = "blake2b"
+
+	// CID is a digest that carries a whole CID, encoded in its default string
+	// encoding. It is used for CIDs whose hash function and codec cannot be
+	// told from a plain digest.
+	//
+	// go-digest has no way to register algorithms, so digest.Digest.Validate
+	// reports these digests as unsupported. Use Validate instead.
+	CID digest.Algorithm = "ipfs-cid"
+)
+
+var (
+	// ErrInvalidDigest is returned for digests that are malformed.
+	ErrInvalidDigest = errors.New("invalid digest")
+
+	// ErrUnsupportedDigest is returned for digests whose algorithm cannot be
+	// mapped to a multihash.
+	ErrUnsupportedDigest = errors.New("unsupported digest algorithm")
+
+	// ErrInvalidCid is returned for CIDs that are malformed.
+	ErrInvalidCid = errors.New("invalid cid")
+
+	// ErrUnsupportedCid is returned for CIDs whose codec or hash function is
+	// not supported.
+	ErrUnsupportedCid = errors.New("unsupported cid")
+)
+
+// codecs are the CID codecs that can be mapped to digests.
+var codecs = map[uint64]struct{}{
+	cid.DagProtobuf: {},
+	cid.Raw:         {},
+	cid.DagCBOR:     {},
+}
+
+// DigestToCid returns the CID identified by dgst.
+//
+// sha256 digests map to CIDv0, and sha512 and blake2b digests to CIDv1, all of
+// dag-pb nodes with untruncated hashes. Any other supported CID, including
+// ones with truncated hashes, is carried by an ipfs-cid digest.
 func DigestToCid(dgst digest.Digest) (cid.Cid, error) {
-	data, err := hex.DecodeString(dgst.Hex())
+	alg, encoded, err := split(dgst)
 	if err != nil {
-		return cid.Cid{}, errors.Wrap(err, "failed to decode digest hex")
+		return cid.Cid{}, err
+	}
+
+	if alg == CID {
+		c, err := cid.Decode(encoded)
+		if err != nil {
+			return cid.Cid{}, errors.Wrapf(ErrInvalidDigest, "%s: %v", dgst, err)
+		}
+
+		err = validateCid(c)
+		if err != nil {
+			return cid.Cid{}, err
+		}
+		return c, nil
 	}
 
-	encoded, err := multihash.Encode(data[:32], multihash.SHA2_256)
+	data, err := hex.DecodeString(encoded)
+	if err != nil || encoded != strings.ToLower(encoded) {
+		return cid.Cid{}, errors.Wrapf(ErrInvalidDigest, "%s: digest is not lower case hex", dgst)
+	}
+
+	var code uint64
+	switch alg {
+	case digest.SHA256:
+		code = multihash.SHA2_256
+	case digest.SHA512:
+		code = multihash.SHA2_512
+	case BLAKE2b:
+		if len(data) == 0 || len(data) > 64 {
+			return cid.Cid{}, errors.Wrapf(ErrInvalidDigest, "%s: invalid blake2b size %d", dgst, len(data))
+		}
+		code = multihash.BLAKE2B_MIN + uint64(len(data)) - 1
+	default:
+		return cid.Cid{}, errors.Wrapf(ErrUnsupportedDigest, "%s", alg)
+	}
+
+	if length, ok := multihash.DefaultLengths[code]; ok && length != len(data) {
+		return cid.Cid{}, errors.Wrapf(ErrInvalidDigest, "%s: expected %d bytes, got %d", dgst, length, len(data))
+	}
+
+	encodedHash, err := multihash.Encode(data, code)
 	if err != nil {
-		return cid.Cid{}, errors.Wrap(err, "failed to encode digest as SHA256 multihash")
+		return cid.Cid{}, errors.Wrapf(ErrInvalidDigest, "%s: %v", dgst, err)
 	}
 
-	return cid.NewCidV0(multihash.Multihash(encoded)), nil
+	if code == multihash.SHA2_256 {
+		return cid.NewCidV0(multihash.Multihash(encodedHash)), nil
+	}
+	return cid.NewCidV1(cid.DagProtobuf, multihash.Multihash(encodedHash)), nil
 }
 
+// CidToDigest returns the digest that identifies c. DigestToCid returns c
+// again for the digest.
 func CidToDigest(c cid.Cid) (digest.Digest, error) {
-	decoded, err := multihash.Decode(c.Hash())
+	err := validateCid(c)
 	if err != nil {
 		return "", err
 	}
 
-	return digest.NewDigestFromBytes(digest.Canonical, decoded.Digest), nil
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return "", errors.Wrapf(ErrInvalidCid, "%s: %v", c, err)
+	}
+
+	// Truncated hashes cannot be told from a plain digest, which always has
+	// the full length of its hash function.
+	if c.Type() == cid.DagProtobuf && decoded.Length == fullLength(decoded.Code) {
+		switch {
+		case c.Version() == 0:
+			return digest.NewDigestFromBytes(digest.SHA256, decoded.Digest), nil
+		case decoded.Code == multihash.SHA2_512:
+			return digest.NewDigestFromBytes(digest.SHA512, decoded.Digest), nil
+		case isBlake2b(decoded.Code):
+			return digest.NewDigestFromBytes(BLAKE2b, decoded.Digest), nil
+		}
+	}
+
+	return digest.NewDigestFromEncoded(CID, c.String()), nil
+}
+
+// Validate returns an error if dgst is malformed or cannot be mapped to a CID.
+func Validate(dgst digest.Digest) error {
+	_, err := DigestToCid(dgst)
+	return err
+}
+
+func split(dgst digest.Digest) (digest.Algorithm, string, error) {
+	i := strings.Index(string(dgst), ":")
+	if i <= 0 || i+1 == len(dgst) {
+		return "", "", errors.Wrapf(ErrInvalidDigest, "%q", dgst)
+	}
+
+	return digest.Algorithm(dgst[:i]), string(dgst[i+1:]), nil
+}
+
+func validateCid(c cid.Cid) error {
+	if !c.Defined() {
+		return errors.Wrap(ErrInvalidCid, "cid is undefined")
+	}
+
+	if _, ok := codecs[c.Type()]; !ok {
+		return errors.Wrapf(ErrUnsupportedCid, "%s: unsupported codec %#x", c, c.Type())
+	}
+
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return errors.Wrapf(ErrInvalidCid, "%s: %v", c, err)
+	}
+
+	switch {
+	case decoded.Code == multihash.SHA2_256, decoded.Code == multihash.SHA2_512, isBlake2b(decoded.Code):
+		return nil
+	default:
+		return errors.Wrapf(ErrUnsupportedCid, "%s: unsupported hash function %#x", c, decoded.Code)
+	}
+}
+
+// fullLength returns the length of the untruncated hashes of the hash function
+// code.
+func fullLength(code uint64) int {
+	if isBlake2b(code) {
+		return int(code-multihash.BLAKE2B_MIN) + 1
+	}
+	return multihash.DefaultLengths[code]
+}
+
+func isBlake2b(code uint64) bool {
+	return code >= multihash.BLAKE2B_MIN && code <= multihash.BLAKE2B_MAX
 }
@@ -1,11 +1,14 @@
 package digestconv
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-util"
+	multihash "github.com/multiformats/go-multihash"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,3 +27,80 @@ func TestCidToDigest(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected.String(), actual.String())
 }
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte("foobar")
+
+	for _, tc := range []struct {
+		codec  uint64
+		code   uint64
+		length int
+		alg    digest.Algorithm
+	}{
+		{cid.DagProtobuf, multihash.SHA2_512, -1, digest.SHA512},
+		{cid.DagProtobuf, multihash.BLAKE2B_MAX, -1, BLAKE2b},
+		{cid.DagProtobuf, multihash.BLAKE2B_MIN + 31, -1, BLAKE2b},
+		{cid.DagProtobuf, multihash.SHA2_256, -1, CID},
+		{cid.Raw, multihash.SHA2_256, -1, CID},
+		{cid.Raw, multihash.SHA2_512, -1, CID},
+		{cid.DagCBOR, multihash.BLAKE2B_MIN + 31, -1, CID},
+
+		// Truncated hashes are carried by the whole CID.
+		{cid.DagProtobuf, multihash.BLAKE2B_MAX, 20, CID},
+		{cid.DagProtobuf, multihash.SHA2_512, 32, CID},
+	} {
+		c, err := cid.Prefix{
+			Version:  1,
+			Codec:    tc.codec,
+			MhType:   tc.code,
+			MhLength: tc.length,
+		}.Sum(data)
+		require.NoError(t, err)
+
+		dgst, err := CidToDigest(c)
+		require.NoError(t, err)
+		require.Equal(t, tc.alg, dgst.Algorithm(), c.String())
+
+		actual, err := DigestToCid(dgst)
+		require.NoError(t, err)
+		require.True(t, c.Equals(actual), "%s != %s", c, actual)
+
+		roundTripped, err := CidToDigest(actual)
+		require.NoError(t, err)
+		require.Equal(t, dgst, roundTripped)
+	}
+}
+
+func TestDigestToCidErrors(t *testing.T) {
+	unsupported, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.GitRaw,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}.Sum([]byte("foobar"))
+	require.NoError(t, err)
+
+	for dgst, expected := range map[digest.Digest]error{
+		"":                      ErrInvalidDigest,
+		"sha256":                ErrInvalidDigest,
+		"sha256:":               ErrInvalidDigest,
+		"sha256:abc":            ErrInvalidDigest,
+		"sha256:zz":             ErrInvalidDigest,
+		"sha256:AB" + zeros(62): ErrInvalidDigest,
+		"sha512:" + zeros(64):   ErrInvalidDigest,
+		"blake2b:" + zeros(130): ErrInvalidDigest,
+		"md5:" + zeros(32):      ErrUnsupportedDigest,
+		"ipfs-cid:notacid":      ErrInvalidDigest,
+		digest.NewDigestFromEncoded(CID, unsupported.String()): ErrUnsupportedCid,
+	} {
+		_, err := DigestToCid(dgst)
+		require.Equal(t, expected, errors.Cause(err), "%q: %v", dgst, err)
+	}
+
+	_, err = CidToDigest(unsupported)
+	require.Equal(t, ErrUnsupportedCid, errors.Cause(err))
+}
+
+func zeros(n int) digest.Digest {
+	return digest.Digest(strings.Repeat("0", n))
+}
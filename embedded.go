@@ -0,0 +1,173 @@
+//go:build embedded && !go1.13
+// +build embedded,!go1.13
+
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/keystore"
+	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/pkg/errors"
+)
+
+// keySize is the size of the RSA key generated for the identity of a new
+// embedded IPFS node.
+const keySize = 2048
+
+var (
+	// The datastores of IPFS repositories are plugins of go-ipfs, which can
+	// only be loaded once per process.
+	pluginsOnce sync.Once
+	pluginsErr  error
+)
+
+func newEmbeddedCoreAPI(ctx context.Context, cfg EmbeddedConfig, offline bool) (iface.CoreAPI, error) {
+	pluginsOnce.Do(func() {
+		pluginsErr = loadPlugins()
+	})
+	if pluginsErr != nil {
+		return nil, pluginsErr
+	}
+
+	r, err := openRepo(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := core.NewNode(ctx, &core.BuildCfg{
+		Online:    !offline,
+		Permanent: true,
+		Repo:      r,
+	})
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "failed to start embedded ipfs node")
+	}
+
+	go func() {
+		<-ctx.Done()
+		node.Close()
+	}()
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		node.Close()
+		return nil, errors.Wrap(err, "failed to create api of embedded ipfs node")
+	}
+
+	return api, nil
+}
+
+func loadPlugins() error {
+	plugins, err := loader.NewPluginLoader("")
+	if err != nil {
+		return errors.Wrap(err, "failed to load ipfs plugins")
+	}
+
+	err = plugins.Initialize()
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize ipfs plugins")
+	}
+
+	err = plugins.Inject()
+	if err != nil {
+		return errors.Wrap(err, "failed to inject ipfs plugins")
+	}
+
+	return nil
+}
+
+// openRepo opens the IPFS repository of the embedded node, initializing it
+// first if it does not exist yet.
+func openRepo(cfg EmbeddedConfig) (repo.Repo, error) {
+	if cfg.Datastore == DatastoreMemory {
+		conf, err := newRepoConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &repo.Mock{
+			C: *conf,
+			D: dssync.MutexWrap(datastore.NewMapDatastore()),
+			K: keystore.NewMemKeystore(),
+		}, nil
+	}
+
+	if !fsrepo.IsInitialized(cfg.RepoPath) {
+		conf, err := newRepoConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fsrepo.Init(cfg.RepoPath, conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize ipfs repo %q", cfg.RepoPath)
+		}
+	}
+
+	r, err := fsrepo.Open(cfg.RepoPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open ipfs repo %q", cfg.RepoPath)
+	}
+
+	// The addresses of an existing repository follow the config of ipcs, but
+	// its datastore cannot be changed without migrating its blocks.
+	conf, err := r.Config()
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrapf(err, "failed to read config of ipfs repo %q", cfg.RepoPath)
+	}
+
+	updated := *conf
+	applyAddresses(&updated, cfg)
+
+	err = r.SetConfig(&updated)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrapf(err, "failed to update config of ipfs repo %q", cfg.RepoPath)
+	}
+
+	return r, nil
+}
+
+// newRepoConfig returns the config of a new IPFS repository, with a new
+// identity.
+func newRepoConfig(cfg EmbeddedConfig) (*config.Config, error) {
+	conf, err := config.Init(ioutil.Discard, keySize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ipfs repo config")
+	}
+
+	if cfg.Datastore == DatastoreBadger {
+		err = config.Profiles["badgerds"].Transform(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to configure badger datastore")
+		}
+	}
+
+	applyAddresses(conf, cfg)
+	return conf, nil
+}
+
+// applyAddresses sets the bootstrap peers and swarm addresses of conf that are
+// configured in cfg.
+func applyAddresses(conf *config.Config, cfg EmbeddedConfig) {
+	if cfg.Bootstrap != nil {
+		conf.Bootstrap = append([]string{}, *cfg.Bootstrap...)
+	}
+
+	if len(cfg.SwarmAddresses) > 0 {
+		conf.Addresses.Swarm = append([]string{}, cfg.SwarmAddresses...)
+	}
+}
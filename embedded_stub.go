@@ -0,0 +1,19 @@
+//go:build !embedded || go1.13
+// +build !embedded go1.13
+
+package ipcs
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/pkg/errors"
+)
+
+// The QUIC transport of go-ipfs v0.4.21 panics on startup unless it is built
+// with Go 1.12, so the embedded node is left out of newer builds rather than
+// taking containerd down with it.
+func newEmbeddedCoreAPI(ctx context.Context, cfg EmbeddedConfig, offline bool) (iface.CoreAPI, error) {
+	return nil, errors.Wrap(errdefs.ErrNotImplemented, "ipcs was built without an embedded ipfs node, rebuild it with -tags embedded and go1.12")
+}
@@ -0,0 +1,19 @@
+//go:build !embedded || go1.13
+// +build !embedded go1.13
+
+package ipcs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedNotBuilt(t *testing.T) {
+	_, err := NewContentStore(context.Background(), Config{
+		Embedded: &EmbeddedConfig{Datastore: DatastoreMemory},
+	})
+	require.True(t, errdefs.IsNotImplemented(err), "%v", err)
+}
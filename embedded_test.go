@@ -0,0 +1,37 @@
+//go:build embedded && !go1.13
+// +build embedded,!go1.13
+
+package ipcs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/testsuite"
+)
+
+// TestEmbeddedContentSuite runs containerd's conformance suite for content
+// stores against a store on an embedded IPFS node that is offline and keeps
+// its blocks in memory.
+func TestEmbeddedContentSuite(t *testing.T) {
+	testsuite.ContentSuite(t, "ipcs-embedded", func(ctx context.Context, root string) (context.Context, content.Store, func() error, error) {
+		nodeCtx, cancel := context.WithCancel(context.Background())
+
+		cs, err := NewContentStore(nodeCtx, Config{
+			Embedded: &EmbeddedConfig{Datastore: DatastoreMemory},
+			Offline:  true,
+			RootDir:  filepath.Join(root, "ipcs"),
+		})
+		if err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+
+		return ctx, cs, func() error {
+			cancel()
+			return nil
+		}, nil
+	})
+}
@@ -0,0 +1,116 @@
+package ipcs
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/pkg/errors"
+)
+
+// Error codes of the IPFS API, as defined by go-ipfs-cmdkit.
+const (
+	ipfsErrClient   = 1
+	ipfsErrNotFound = 3
+)
+
+// notFoundMessages are the messages of the IPFS errors for content that does
+// not exist, which the IPFS API does not always report with its not found
+// code.
+var notFoundMessages = []string{
+	ipld.ErrNotFound.Error(),
+	"blockservice: key not found",
+	"not found locally",
+	"not pinned",
+	"no link named",
+}
+
+// ipfsError classifies an error returned by IPFS as one of containerd's errdefs
+// errors, so that callers can branch on it:
+//
+//   - content that does not exist is ErrNotFound.
+//   - malformed requests are ErrInvalidArgument.
+//   - an IPFS API that cannot be reached or that timed out is ErrUnavailable.
+//   - commands the IPFS API does not have are ErrNotImplemented.
+//
+// Errors that are already classified, or caused by the cancellation of the
+// caller's context, are returned as is.
+func ipfsError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	cause := errors.Cause(err)
+	switch {
+	case cause == context.Canceled, cause == context.DeadlineExceeded:
+		return err
+	case errdefs.IsInvalidArgument(err), errdefs.IsNotFound(err), errdefs.IsAlreadyExists(err),
+		errdefs.IsFailedPrecondition(err), errdefs.IsUnavailable(err), errdefs.IsNotImplemented(err):
+		return err
+	case cause == ipld.ErrNotFound:
+		return errors.Wrapf(errdefs.ErrNotFound, "%v", err)
+	}
+
+	if apiErr, ok := cause.(*httpapi.Error); ok {
+		switch {
+		case apiErr.Message == "command not found":
+			return errors.Wrapf(errdefs.ErrNotImplemented, "ipfs api command %q", apiErr.Command)
+		case apiErr.Code == ipfsErrNotFound, isNotFoundMessage(apiErr.Message):
+			return errors.Wrapf(errdefs.ErrNotFound, "%v", err)
+		case apiErr.Code == ipfsErrClient:
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "%v", err)
+		}
+		return err
+	}
+
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return errors.Wrapf(errdefs.ErrUnavailable, "ipfs api timed out: %v", err)
+	}
+
+	if isUnreachable(cause) {
+		return errors.Wrapf(errdefs.ErrUnavailable, "ipfs api is unreachable: %v", err)
+	}
+
+	if isNotFoundMessage(err.Error()) {
+		return errors.Wrapf(errdefs.ErrNotFound, "%v", err)
+	}
+
+	return err
+}
+
+func isNotFoundMessage(msg string) bool {
+	for _, m := range notFoundMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnreachable returns whether err is caused by failing to connect to the IPFS
+// API, e.g. because the daemon is not running.
+func isUnreachable(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			if e.Op == "dial" {
+				return true
+			}
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET || e == syscall.ENOENT
+		default:
+			return false
+		}
+	}
+}
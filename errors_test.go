@@ -0,0 +1,121 @@
+package ipcs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	ipld "github.com/ipfs/go-ipld-format"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIpfsError(t *testing.T) {
+	require.NoError(t, ipfsError(nil))
+
+	for _, tc := range []struct {
+		err      error
+		expected func(error) bool
+	}{
+		{ipld.ErrNotFound, errdefs.IsNotFound},
+		{errors.Wrap(ipld.ErrNotFound, "failed to get"), errdefs.IsNotFound},
+		{&httpapi.Error{Message: "merkledag: not found"}, errdefs.IsNotFound},
+		{&httpapi.Error{Code: ipfsErrNotFound, Message: "no such file"}, errdefs.IsNotFound},
+		{&httpapi.Error{Code: ipfsErrClient, Message: "invalid path \"foo\""}, errdefs.IsInvalidArgument},
+		{&httpapi.Error{Command: "dag/stat", Message: "command not found"}, errdefs.IsNotImplemented},
+		{errors.New("not pinned or pinned indirectly"), errdefs.IsNotFound},
+		{errdefs.ErrAlreadyExists, errdefs.IsAlreadyExists},
+	} {
+		require.True(t, tc.expected(ipfsError(tc.err)), "%v: %v", tc.err, ipfsError(tc.err))
+	}
+
+	// Cancellation by the caller is passed on as is.
+	err := errors.Wrap(context.Canceled, "failed to get")
+	require.Equal(t, err, ipfsError(err))
+
+	// Errors that cannot be classified are passed on as is.
+	err = &httpapi.Error{Code: 2, Message: "internal error"}
+	require.Equal(t, err, ipfsError(err))
+}
+
+func TestStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	desc := ocispec.Descriptor{Digest: testDigest(t, []byte("missing"))}
+
+	_, err := s.Info(ctx, desc.Digest)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	_, err = s.ReaderAt(ctx, desc)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	_, err = s.Fetch(ctx, desc)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	err = s.Delete(ctx, desc.Digest)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	// Content that does not exist yet can be written.
+	w, err := s.Writer(ctx, content.WithRef("missing"), content.WithDescriptor(desc))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	// Nothing listens on a port that was just closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().(*net.TCPAddr)
+	require.NoError(t, l.Close())
+
+	cln, err := Config{Address: "/ip4/127.0.0.1/tcp/" + strconv.Itoa(addr.Port)}.NewCoreAPI(context.Background())
+	require.NoError(t, err)
+	s := newStore(NewCoreAPIBackend(cln))
+
+	dgst := testDigest(t, []byte("unreachable"))
+
+	_, err = s.Info(ctx, dgst)
+	require.True(t, errdefs.IsUnavailable(err), "%v", err)
+
+	_, err = s.Writer(ctx, content.WithRef("unreachable"), content.WithDescriptor(ocispec.Descriptor{Digest: dgst}))
+	require.True(t, errdefs.IsUnavailable(err), "%v", err)
+}
+
+func TestStoreTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	cln, err := Config{
+		Address: "/ip4/127.0.0.1/tcp/" + strconv.Itoa(addr.Port),
+		Timeout: Duration(100 * time.Millisecond),
+	}.NewCoreAPI(context.Background())
+	require.NoError(t, err)
+	s := newStore(NewCoreAPIBackend(cln))
+
+	_, err = s.Info(ctx, testDigest(t, []byte("timeout")))
+	require.True(t, errdefs.IsUnavailable(err), "%v", err)
+	require.True(t, strings.Contains(err.Error(), "timed out"), "%v", err)
+}
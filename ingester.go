@@ -1,15 +1,18 @@
 package ipcs
 
 import (
+	"bytes"
 	"context"
+	"encoding"
 	"io"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/hinshun/ipcs/digestconv"
 	files "github.com/ipfs/go-ipfs-files"
-	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	digest "github.com/opencontainers/go-digest"
@@ -24,45 +27,124 @@ func (s *store) Writer(ctx context.Context, opts ...content.WriterOpt) (content.
 		}
 	}
 
+	if wOpts.Ref == "" {
+		return nil, errors.Wrap(errdefs.ErrInvalidArgument, "ref must not be empty")
+	}
+
 	if wOpts.Desc.Digest != "" {
-		c, err := digestconv.DigestToCid(wOpts.Desc.Digest)
+		c, key, err := s.resolve(wOpts.Desc.Digest)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to convert digest '%s' to cid", wOpts.Desc.Digest)
+			return nil, err
 		}
 
-		_, err = s.cln.Unixfs().Get(ctx, path.IpfsPath(c))
-		if err == nil {
+		_, err = s.localSize(ctx, c)
+		switch {
+		case err == nil:
+			// The content is now also known by the expected digest, since the
+			// caller takes it to be stored under it.
+			if s.meta != nil {
+				err = s.meta.addDigest(key, wOpts.Desc.Digest)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to update metadata of %q", key)
+				}
+			}
 			return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "content %v", wOpts.Desc.Digest)
+		case !errdefs.IsNotFound(err):
+			return nil, errors.Wrapf(err, "failed to check if content %v exists", wOpts.Desc.Digest)
 		}
 	}
 
+	now := time.Now()
 	w := &writer{
-		ctx:   ctx,
-		cln:   s.cln,
-		ref:   wOpts.Ref,
-		total: wOpts.Desc.Size,
+		ctx:       ctx,
+		s:         s,
+		backend:   s.backend,
+		ref:       wOpts.Ref,
+		total:     wOpts.Desc.Size,
+		startedAt: now,
+		updatedAt: now,
 	}
 
-	err := w.Truncate(0)
+	// Resume from the partial data of a previously closed writer for the same
+	// ref.
+	s.ingestsMu.Lock()
+	prev, ok := s.ingests[wOpts.Ref]
+	if ok {
+		if !prev.isClosed() {
+			s.ingestsMu.Unlock()
+			return nil, errors.Wrapf(errdefs.ErrUnavailable, "ref %s locked", wOpts.Ref)
+		}
+
+		if w.total > 0 && prev.total > 0 && w.total != prev.total {
+			s.ingestsMu.Unlock()
+			return nil, errors.Errorf("provided total differs from status: %v != %v", w.total, prev.total)
+		}
+
+		if w.total == 0 {
+			w.total = prev.total
+		}
+		w.partial = prev.partial
+		w.partialSize = prev.partialSize
+		w.partialState = prev.partialState
+		w.startedAt = prev.startedAt
+		w.updatedAt = prev.updatedAt
+	}
+	s.ingests[wOpts.Ref] = w
+	s.ingestsMu.Unlock()
+
+	err := w.start(w.partialSize)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to truncate writer")
+		s.ingestsMu.Lock()
+		if ok {
+			s.ingests[wOpts.Ref] = prev
+		} else {
+			delete(s.ingests, wOpts.Ref)
+		}
+		s.ingestsMu.Unlock()
+		return nil, errors.Wrap(err, "failed to start writer")
 	}
 
 	return w, nil
 }
 
 type writer struct {
-	ctx       context.Context
-	cln       iface.CoreAPI
-	ref       string
+	ctx     context.Context
+	s       *store
+	backend Backend
+	ref     string
+	total   int64
+	pw      *io.PipeWriter
+	cancel  func() error
+
+	// done is closed when the in-flight add has returned.
+	done chan struct{}
+
+	// partial is the data flushed to IPFS by a previous Close or Truncate. The
+	// in-flight add always starts by re-reading the first base bytes of it.
+	partial     path.Resolved
+	partialSize int64
+	base        int64
+
+	// partialState is the marshaled state of the digester after the partial
+	// data, and baseState after the first base bytes of it.
+	partialState []byte
+	baseState    []byte
+
+	// mu guards the progress and result of the writer, which may be read
+	// concurrently through the store's Status and ListStatuses or updated by
+	// the in-flight add.
+	mu        sync.Mutex
 	offset    int64
-	total     int64
-	dgst      digest.Digest
 	startedAt time.Time
 	updatedAt time.Time
-	pw        io.Writer
+	closed    bool
+	added     path.Resolved
 	ipfsErr   error
-	cancel    func() error
+	dgst      digest.Digest
+
+	// digester computes the sha256 of the bytes written, which is an alias of
+	// the digest of the CID the data is added as.
+	digester digest.Digester
 }
 
 // Write writes len(p) bytes from p to the underlying data stream.
@@ -73,13 +155,24 @@ type writer struct {
 //
 // Implementations must not retain p.
 func (w *writer) Write(p []byte) (n int, err error) {
-	if w.ipfsErr != nil {
-		return 0, w.ipfsErr
+	w.mu.Lock()
+	err = w.ipfsErr
+	w.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.pw == nil {
+		return 0, errors.New("writer is closed")
 	}
 
 	n, err = w.pw.Write(p)
+
+	w.mu.Lock()
+	w.digester.Hash().Write(p[:n])
 	w.offset += int64(n)
 	w.updatedAt = time.Now()
+	w.mu.Unlock()
 	return n, err
 }
 
@@ -87,12 +180,26 @@ func (w *writer) Write(p []byte) (n int, err error) {
 // committed this allows resuming or aborting.
 // Calling Close on a closed writer will not error.
 func (w *writer) Close() error {
-	return w.cancel()
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+
+	// Keep what has been written so far, so that a writer opened later with
+	// the same ref can resume from it.
+	return w.flush()
 }
 
 // Digest may return empty digest or panics until committed.
+//
+// Until committed, it returns the sha256 of the bytes written so far.
 func (w *writer) Digest() digest.Digest {
-	return w.dgst
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.dgst != "" {
+		return w.dgst
+	}
+	return w.digester.Digest()
 }
 
 // Commit commits the blob (but no roll-back is guaranteed on an error).
@@ -100,19 +207,146 @@ func (w *writer) Digest() digest.Digest {
 // Commit always closes the writer, even on error.
 // ErrAlreadyExists aborts the writer.
 func (w *writer) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
-	if size > 0 && size != w.offset {
-		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected commit size %d, expected %d", w.offset, size)
+	// A failed commit leaves the written data as the partial data of the
+	// ingest, so that it can still be resumed or aborted, unless it has the
+	// wrong digest and the store has no metadata.
+	err := w.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to add content to ipfs")
 	}
 
-	if expected != "" && expected != w.dgst {
-		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected commit digest %s, expected %s", w.dgst, expected)
+	if w.partial == nil {
+		return errors.Wrap(errdefs.ErrFailedPrecondition, "writer has already been committed")
+	}
+
+	var base content.Info
+	for _, opt := range opts {
+		err := opt(&base)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	offset := w.offset
+	w.mu.Unlock()
+
+	if size > 0 && size != offset {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected commit size %d, expected %d", offset, size)
 	}
 
-	return w.Close()
+	dgst, err := digestconv.CidToDigest(w.partial.Cid())
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert cid %q to digest", w.partial.Cid())
+	}
+
+	w.mu.Lock()
+	alias := w.digester.Digest()
+	w.mu.Unlock()
+
+	// The content may be committed by either the digest of its CID or the
+	// sha256 of its bytes. Without an expected digest, it is committed by the
+	// sha256 like any other content store, unless there is no metadata to
+	// look it up by.
+	committed := dgst
+	switch expected {
+	case alias:
+		committed = alias
+	case dgst:
+	case "":
+		if w.s.meta != nil {
+			committed = alias
+		}
+	default:
+		// Callers rarely abort a failed commit, and without metadata the
+		// partial data would never be unpinned when the store is reopened,
+		// so data of the wrong digest is unpinned like an aborted ingest.
+		if w.s.meta == nil {
+			w.s.release(w)
+			err = w.unpinPartial(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to unpin content of unexpected commit digest %s", alias)
+			}
+		}
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected commit digest %s, expected %s", alias, expected)
+	}
+
+	if w.s.meta != nil {
+		// Content is only known to have been committed before when there is
+		// metadata, as adding it again to IPFS is otherwise indistinguishable
+		// from adding it the first time.
+		rec, err := w.s.meta.lookup(dgst)
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up metadata of %q", dgst)
+		}
+
+		// The pin is shared with the existing content, so it is kept, and the
+		// content is now also known by the committed digest.
+		if rec.committed() {
+			err = w.s.meta.addDigest(dgst, committed)
+			if err != nil {
+				return errors.Wrapf(err, "failed to update metadata of %q", dgst)
+			}
+
+			err = w.releaseCommitted(ctx)
+			if err != nil {
+				return err
+			}
+			w.s.release(w)
+			w.partial, w.partialSize, w.partialState = nil, 0, nil
+			return errors.Wrapf(errdefs.ErrAlreadyExists, "content %v", committed)
+		}
+
+		err = w.s.meta.addAlias(dgst, alias)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add alias %q of %q", alias, dgst)
+		}
+
+		_, err = w.s.meta.update(dgst, func(rec *contentRecord) error {
+			if base.Labels != nil {
+				rec.Labels = copyLabels(base.Labels)
+			}
+			if !containsDigest(rec.Digests, committed) {
+				rec.Digests = append(rec.Digests, committed)
+			}
+			rec.UpdatedAt = time.Now().UTC()
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update metadata of %q", dgst)
+		}
+	}
+
+	// The partial data is now committed content, so it stays pinned.
+	err = w.releaseCommitted(ctx)
+	if err != nil {
+		return err
+	}
+	w.s.release(w)
+	w.partial, w.partialSize, w.partialState = nil, 0, nil
+
+	w.mu.Lock()
+	w.dgst = committed
+	w.mu.Unlock()
+	return nil
+}
+
+// releaseCommitted releases the partial data of the writer once it has been
+// committed, and pins it with the pin mode of the store unless another ingest
+// still has it as partial data.
+func (w *writer) releaseCommitted(ctx context.Context) error {
+	last, err := w.s.releasePartial(w.partial)
+	if err != nil || !last {
+		return err
+	}
+	return w.s.repin(ctx, w.partial)
 }
 
 // Status returns the current state of write
 func (w *writer) Status() (content.Status, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	return content.Status{
 		Ref:       w.ref,
 		Offset:    w.offset,
@@ -124,52 +358,246 @@ func (w *writer) Status() (content.Status, error) {
 
 // Truncate updates the size of the target blob
 func (w *writer) Truncate(size int64) error {
-	if size != 0 {
-		return errors.New("Truncate: unsupported size")
+	w.mu.Lock()
+	offset := w.offset
+	w.mu.Unlock()
+
+	if size < 0 || size > offset {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "cannot truncate to %d, only %d bytes written", size, offset)
+	}
+
+	err := w.flush()
+	if err != nil {
+		return errors.Wrap(err, "failed to flush written data")
 	}
 
-	if w.cancel != nil {
-		err := w.cancel()
+	err = w.start(size)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.updatedAt = time.Now()
+	w.mu.Unlock()
+	return nil
+}
+
+// start begins a new add that reads the first size bytes of the partial data,
+// followed by everything written to the writer from now on.
+func (w *writer) start(size int64) error {
+	var prefix io.ReadCloser = ioutil.NopCloser(&bytes.Buffer{})
+	if size > 0 {
+		n, err := w.backend.Get(w.ctx, w.partial)
 		if err != nil {
-			return err
+			return errors.Wrapf(ipfsError(err), "failed to get partial data %q", w.partial)
 		}
+		prefix = files.ToFile(n)
+	}
+
+	digester, err := w.resumeDigester(size)
+	if err != nil {
+		prefix.Close()
+		return err
 	}
 
-	var r io.ReadCloser
-	r, w.pw = io.Pipe()
+	state, err := marshalDigester(digester)
+	if err != nil {
+		prefix.Close()
+		return err
+	}
 
+	r, pw := io.Pipe()
 	ctx, cancel := context.WithCancel(w.ctx)
+	done := make(chan struct{})
+
 	go func() {
-		p, err := w.cln.Unixfs().Add(ctx, files.NewReaderFile(r), options.Unixfs.Pin(true))
-		if err != nil {
-			w.ipfsErr = err
-			return
-		}
+		defer close(done)
+		defer prefix.Close()
 
-		dgst, err := digestconv.CidToDigest(p.Cid())
+		in := io.MultiReader(io.LimitReader(prefix, size), r)
+		opts := append([]options.UnixfsAddOption{options.Unixfs.Pin(true)}, w.s.addOpts...)
+		p, err := w.backend.Add(ctx, files.NewReaderFile(in), opts...)
+		if err == nil {
+			// The added data is only partial data until it is committed,
+			// even though it is pinned to keep it from being garbage
+			// collected.
+			err = w.s.markPartial(p)
+			if err != nil {
+				w.backend.Unpin(w.ctx, p)
+				p = nil
+			}
+		}
 		if err != nil {
-			w.ipfsErr = err
-			return
+			err = ipfsError(err)
+			r.CloseWithError(err)
 		}
 
-		w.dgst = dgst
+		w.mu.Lock()
+		w.added, w.ipfsErr = p, err
+		w.mu.Unlock()
 	}()
 
 	w.cancel = func() error {
 		cancel()
-		w.ipfsErr = nil
 
-		err := w.Close()
+		err := pw.Close()
 		if err != nil {
 			return err
 		}
 
-		return r.Close()
+		err = r.Close()
+		if err != nil {
+			return err
+		}
+		<-done
+
+		// The add may have finished before it was cancelled, in which case its
+		// result is pinned and needs to be released.
+		w.mu.Lock()
+		added := w.added
+		w.added, w.ipfsErr = nil, errors.Errorf("ingest ref %q aborted", w.ref)
+		w.mu.Unlock()
+
+		if added == nil {
+			return nil
+		}
+		return w.s.unpinPartial(w.ctx, added)
 	}
 
-	now := time.Now()
-	w.startedAt = now
-	w.updatedAt = now
-	w.offset = 0
+	w.pw = pw
+	w.done = done
+	w.base = size
+	w.baseState = state
+
+	w.mu.Lock()
+	w.digester = digester
+	w.offset = size
+	w.added, w.ipfsErr = nil, nil
+	w.mu.Unlock()
 	return nil
 }
+
+// flush closes the input of the in-flight add and waits for it to finish. On
+// success, the added data replaces the partial data of the writer. Otherwise
+// the writer falls back to the bytes it already had in the partial data.
+func (w *writer) flush() error {
+	if w.pw == nil {
+		return nil
+	}
+
+	err := w.pw.Close()
+	w.pw = nil
+	if err != nil {
+		return err
+	}
+	<-w.done
+
+	w.mu.Lock()
+	added, ipfsErr := w.added, w.ipfsErr
+	if ipfsErr != nil {
+		w.offset = w.base
+		w.digester = digest.Canonical.Digester()
+		err = unmarshalDigester(w.digester, w.baseState)
+	}
+	offset := w.offset
+	w.mu.Unlock()
+
+	if ipfsErr != nil {
+		if err != nil {
+			return errors.Wrapf(ipfsErr, "failed to restore digester: %v", err)
+		}
+		return ipfsErr
+	}
+
+	w.mu.Lock()
+	state, err := marshalDigester(w.digester)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The added data is now the partial data, and is no longer released by
+	// cancel. The previous partial data stays pinned if it is the same as the
+	// added data, which has its own mark.
+	w.mu.Lock()
+	w.added = nil
+	w.mu.Unlock()
+
+	prev := w.partial
+	w.partial, w.partialSize, w.partialState = added, offset, state
+	if prev != nil {
+		return w.s.unpinPartial(w.ctx, prev)
+	}
+
+	return nil
+}
+
+// unpinPartial releases the data flushed by a previous Close or Truncate.
+func (w *writer) unpinPartial(ctx context.Context) error {
+	if w.partial == nil {
+		return nil
+	}
+
+	err := w.s.unpinPartial(ctx, w.partial)
+	if err != nil {
+		return err
+	}
+	w.partial, w.partialSize, w.partialState = nil, 0, nil
+
+	return nil
+}
+
+// resumeDigester returns a digester that has already seen the first size bytes
+// of the partial data.
+func (w *writer) resumeDigester(size int64) (digest.Digester, error) {
+	digester := digest.Canonical.Digester()
+	if size == 0 {
+		return digester, nil
+	}
+
+	if size == w.partialSize && w.partialState != nil {
+		err := unmarshalDigester(digester, w.partialState)
+		if err != nil {
+			return nil, err
+		}
+		return digester, nil
+	}
+
+	n, err := w.backend.Get(w.ctx, w.partial)
+	if err != nil {
+		return nil, errors.Wrapf(ipfsError(err), "failed to get partial data %q", w.partial)
+	}
+
+	f := files.ToFile(n)
+	defer f.Close()
+
+	_, err = io.CopyN(digester.Hash(), f, size)
+	if err != nil {
+		return nil, errors.Wrapf(ipfsError(err), "failed to digest partial data %q", w.partial)
+	}
+
+	return digester, nil
+}
+
+func marshalDigester(digester digest.Digester) ([]byte, error) {
+	m, ok := digester.Hash().(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.New("digester state cannot be marshaled")
+	}
+	return m.MarshalBinary()
+}
+
+func unmarshalDigester(digester digest.Digester, state []byte) error {
+	u, ok := digester.Hash().(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("digester state cannot be unmarshaled")
+	}
+	return u.UnmarshalBinary(state)
+}
+
+func (w *writer) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closed
+}
@@ -4,24 +4,267 @@ import (
 	"context"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/log"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
 // Status returns the status of the provided ref.
 func (s *store) Status(ctx context.Context, ref string) (content.Status, error) {
-	panic("unimplemented")
-	return content.Status{}, nil
+	s.ingestsMu.Lock()
+	w, ok := s.ingests[ref]
+	s.ingestsMu.Unlock()
+
+	if !ok {
+		return content.Status{}, errors.Wrapf(errdefs.ErrNotFound, "ingest ref %q", ref)
+	}
+
+	return w.Status()
 }
 
 // ListStatuses returns the status of any active ingestions whose ref match the
 // provided regular expression. If empty, all active ingestions will be
 // returned.
-func (s *store) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
-	panic("unimplemented")
-	return nil, nil
+func (s *store) ListStatuses(ctx context.Context, fs ...string) ([]content.Status, error) {
+	filter, err := filters.ParseAll(fs...)
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to parse filters: %v", err)
+	}
+
+	s.ingestsMu.Lock()
+	writers := make([]*writer, 0, len(s.ingests))
+	for _, w := range s.ingests {
+		writers = append(writers, w)
+	}
+	s.ingestsMu.Unlock()
+
+	var active []content.Status
+	for _, w := range writers {
+		status, err := w.Status()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get status of ingest ref %q", w.ref)
+		}
+
+		if filter.Match(adaptStatus(status)) {
+			active = append(active, status)
+		}
+	}
+
+	return active, nil
 }
 
 // Abort completely cancels the ingest operation targeted by ref.
 func (s *store) Abort(ctx context.Context, ref string) error {
-	panic("unimplemented")
+	s.ingestsMu.Lock()
+	w, ok := s.ingests[ref]
+	delete(s.ingests, ref)
+	s.ingestsMu.Unlock()
+
+	if !ok {
+		return errors.Wrapf(errdefs.ErrNotFound, "ingest ref %q", ref)
+	}
+
+	err := w.cancel()
+	if err != nil {
+		return errors.Wrapf(err, "failed to cancel ingest ref %q", ref)
+	}
+
+	return w.unpinPartial(ctx)
+}
+
+// release removes the writer from the active ingests if it is still the
+// writer registered for its ref.
+func (s *store) release(w *writer) {
+	s.ingestsMu.Lock()
+	defer s.ingestsMu.Unlock()
+
+	if s.ingests[w.ref] == w {
+		delete(s.ingests, w.ref)
+	}
+}
+
+// markPartial records that the data at p is pinned as the partial data of an
+// ingest, so that Walk leaves it out until it is committed, and a store
+// reopened before that unpins it.
+func (s *store) markPartial(p path.Resolved) error {
+	if s.meta != nil {
+		dgst, err := digestconv.CidToDigest(p.Cid())
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert cid %q to digest", p.Cid())
+		}
+
+		err = s.meta.addPartial(dgst)
+		if err != nil {
+			return errors.Wrapf(err, "failed to record partial data %q", p)
+		}
+	}
+
+	s.partialsMu.Lock()
+	s.partials[p.Cid()]++
+	s.partialsMu.Unlock()
+	return nil
+}
+
+// releasePartial forgets that the data at p is pinned as the partial data of
+// an ingest, and returns whether no other ingest has it as partial data.
+func (s *store) releasePartial(p path.Resolved) (bool, error) {
+	s.partialsMu.Lock()
+	s.partials[p.Cid()]--
+	last := s.partials[p.Cid()] <= 0
+	if last {
+		delete(s.partials, p.Cid())
+	}
+	s.partialsMu.Unlock()
+
+	if !last || s.meta == nil {
+		return last, nil
+	}
+
+	dgst, err := digestconv.CidToDigest(p.Cid())
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to convert cid %q to digest", p.Cid())
+	}
+
+	err = s.meta.removePartial(dgst)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to forget partial data %q", p)
+	}
+	return true, nil
+}
+
+// unpinPartial releases the partial data at p, and unpins it unless another
+// ingest still has it as partial data, or it has been committed as content.
+func (s *store) unpinPartial(ctx context.Context, p path.Resolved) error {
+	last, err := s.releasePartial(p)
+	if err != nil || !last {
+		return err
+	}
+
+	committed, err := s.isCommitted(p.Cid())
+	if err != nil {
+		return err
+	}
+	if committed {
+		return s.repin(ctx, p)
+	}
+
+	err = s.backend.Unpin(ctx, p)
+	if err != nil {
+		return errors.Wrapf(ipfsError(err), "failed to unpin partial data %q", p)
+	}
 	return nil
 }
+
+// repin pins the committed content at p with the pin mode of the store, in
+// place of the recursive pin of its partial data.
+func (s *store) repin(ctx context.Context, p path.Resolved) error {
+	if s.pinMode == PinRecursive {
+		return nil
+	}
+
+	err := s.backend.Unpin(ctx, p)
+	if err != nil {
+		return errors.Wrapf(ipfsError(err), "failed to unpin %q", p)
+	}
+
+	if s.pinMode == PinDirect {
+		err = s.backend.Pin(ctx, p, options.Pin.Recursive(false))
+		if err != nil {
+			return errors.Wrapf(ipfsError(err), "failed to pin %q", p)
+		}
+	}
+	return nil
+}
+
+// isPartial returns whether the pin of c is only the partial data of ingests.
+func (s *store) isPartial(c cid.Cid) (bool, error) {
+	s.partialsMu.Lock()
+	n := s.partials[c]
+	s.partialsMu.Unlock()
+
+	if n == 0 {
+		return false, nil
+	}
+
+	committed, err := s.isCommitted(c)
+	return !committed, err
+}
+
+// isCommitted returns whether c has been committed as content, which is only
+// known when the store has metadata.
+func (s *store) isCommitted(c cid.Cid) (bool, error) {
+	if s.meta == nil {
+		return false, nil
+	}
+
+	dgst, err := digestconv.CidToDigest(c)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to convert cid %q to digest", c)
+	}
+
+	rec, err := s.meta.lookup(dgst)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to look up metadata of %q", dgst)
+	}
+	return rec.committed(), nil
+}
+
+// unpinStalePartials unpins the partial data of the ingests of a previous run
+// of the store, since ingests do not outlive the store. Partial data that
+// cannot be unpinned yet is kept to be unpinned the next time.
+func (s *store) unpinStalePartials(ctx context.Context) {
+	dgsts, err := s.meta.partials()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list stale partial data")
+		return
+	}
+
+	for _, dgst := range dgsts {
+		err := s.unpinStalePartial(ctx, dgst)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("digest", dgst).Warn("failed to unpin stale partial data")
+		}
+	}
+}
+
+func (s *store) unpinStalePartial(ctx context.Context, dgst digest.Digest) error {
+	c, err := digestconv.DigestToCid(dgst)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert digest %q to cid", dgst)
+	}
+
+	committed, err := s.isCommitted(c)
+	if err != nil {
+		return err
+	}
+
+	if !committed {
+		err = s.backend.Unpin(ctx, path.IpfsPath(c))
+		if err != nil && !errdefs.IsNotFound(ipfsError(err)) {
+			return errors.Wrapf(ipfsError(err), "failed to unpin %q", c)
+		}
+	}
+
+	return s.meta.removePartial(dgst)
+}
+
+func adaptStatus(status content.Status) filters.Adaptor {
+	return filters.AdapterFunc(func(fieldpath []string) (string, bool) {
+		if len(fieldpath) == 0 {
+			return "", false
+		}
+
+		switch fieldpath[0] {
+		case "ref":
+			return status.Ref, true
+		}
+
+		return "", false
+	})
+}
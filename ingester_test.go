@@ -0,0 +1,669 @@
+package ipcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/hinshun/ipcs/digestconv"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func TestWriterCommit(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1<<20)
+	dgst := testDigest(t, data)
+
+	w, err := s.Writer(ctx, content.WithRef("commit"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+
+	err = w.Commit(ctx, int64(len(data)), dgst)
+	require.NoError(t, err)
+	require.Equal(t, dgst, w.Digest())
+
+	c, err := digestconv.DigestToCid(dgst)
+	require.NoError(t, err)
+	require.True(t, backend.isPinned(c))
+
+	_, err = s.Status(ctx, "commit")
+	require.True(t, errdefs.IsNotFound(err))
+}
+
+func TestWriterPinMode(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, mode := range []PinMode{PinRecursive, PinDirect, PinNone} {
+		backend := newTestBackend()
+		cs, err := NewContentStoreFromBackend(backend, WithConfig(Config{
+			PinMode: mode,
+			RootDir: filepath.Join(root, string(mode)),
+		}))
+		require.NoError(t, err)
+
+		data := randomData(t, 1<<20)
+		dgst := testDigest(t, data)
+		require.NoError(t, content.WriteBlob(ctx, cs, "pin", bytes.NewReader(data), ocispec.Descriptor{Digest: dgst}))
+
+		var pinned []string
+		for _, pinType := range []options.PinLsOption{options.Pin.Type.Recursive(), options.Pin.Type.Direct()} {
+			pins, err := backend.Pins(ctx, pinType)
+			require.NoError(t, err)
+			for _, pin := range pins {
+				require.Equal(t, dgst, pinDigest(t, pin), mode)
+				pinned = append(pinned, pin.Type())
+			}
+		}
+
+		switch mode {
+		case PinNone:
+			require.Empty(t, pinned)
+		default:
+			require.Equal(t, []string{string(mode)}, pinned)
+		}
+
+		_, err = cs.Info(ctx, dgst)
+		require.NoError(t, err, mode)
+
+		require.NoError(t, cs.Delete(ctx, dgst), mode)
+
+		c, err := digestconv.DigestToCid(dgst)
+		require.NoError(t, err)
+		require.False(t, backend.isPinned(c), mode)
+	}
+}
+
+func TestWriterCommitDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1024)
+	dgst := testDigest(t, data)
+
+	w, err := s.Writer(ctx, content.WithRef("mismatch"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+
+	err = w.Commit(ctx, int64(len(data)), testDigest(t, []byte("other")))
+	require.True(t, errdefs.IsFailedPrecondition(err))
+
+	// Without metadata, the wrong content is unpinned, since callers do not
+	// abort a failed commit and it would otherwise stay pinned for good.
+	_, err = s.Status(ctx, "mismatch")
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	c, err := digestconv.DigestToCid(dgst)
+	require.NoError(t, err)
+	require.False(t, backend.isPinned(c))
+
+	err = s.Abort(ctx, "mismatch")
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	// With metadata, the wrong content stays around to be resumed or
+	// aborted, and is unpinned when the store is reopened otherwise.
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s = newTestStore(t, backend, root)
+
+	w, err = s.Writer(ctx, content.WithRef("mismatch"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+
+	err = w.Commit(ctx, int64(len(data)), testDigest(t, []byte("other")))
+	require.True(t, errdefs.IsFailedPrecondition(err))
+
+	status, err := s.Status(ctx, "mismatch")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), status.Offset)
+	require.True(t, backend.isPinned(c))
+
+	require.NoError(t, s.Abort(ctx, "mismatch"))
+	require.False(t, backend.isPinned(c))
+}
+
+func TestWriterCommitSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	data := randomData(t, 1024)
+
+	w, err := s.Writer(ctx, content.WithRef("size"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:512])
+	require.NoError(t, err)
+
+	err = w.Commit(ctx, int64(len(data)), "")
+	require.True(t, errdefs.IsFailedPrecondition(err))
+
+	// The short write stays around to be resumed.
+	status, err := s.Status(ctx, "size")
+	require.NoError(t, err)
+	require.Equal(t, int64(512), status.Offset)
+}
+
+func TestWriterResume(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1<<20)
+	dgst := testDigest(t, data)
+	half := len(data) / 2
+
+	w, err := s.Writer(ctx, content.WithRef("resume"), content.WithDescriptor(ocispec.Descriptor{Digest: dgst, Size: int64(len(data))}))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:half])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	status, err := s.Status(ctx, "resume")
+	require.NoError(t, err)
+	require.Equal(t, int64(half), status.Offset)
+	require.Equal(t, int64(len(data)), status.Total)
+
+	w, err = s.Writer(ctx, content.WithRef("resume"))
+	require.NoError(t, err)
+
+	status, err = w.Status()
+	require.NoError(t, err)
+	require.Equal(t, int64(half), status.Offset)
+
+	_, err = w.Write(data[half:])
+	require.NoError(t, err)
+
+	err = w.Commit(ctx, int64(len(data)), dgst)
+	require.NoError(t, err)
+
+	// Only the committed content should remain pinned.
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+}
+
+func TestWriterPartialsNotWalked(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	data := randomData(t, 1<<20)
+	alias := digest.FromBytes(data)
+
+	walk := func() []digest.Digest {
+		var dgsts []digest.Digest
+		err := s.Walk(ctx, func(info content.Info) error {
+			dgsts = append(dgsts, info.Digest)
+			return nil
+		})
+		require.NoError(t, err)
+		return dgsts
+	}
+
+	w, err := s.Writer(ctx, content.WithRef("partial"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:12])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// The partial data is pinned, but it is not content.
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+	require.Empty(t, walk())
+
+	w, err = s.Writer(ctx, content.WithRef("partial"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[12:])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Empty(t, walk())
+
+	// Walking the partial data does not make it look committed already.
+	w, err = s.Writer(ctx, content.WithRef("partial"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx, int64(len(data)), alias))
+	require.Len(t, walk(), 1)
+
+	_, err = s.Info(ctx, alias)
+	require.NoError(t, err)
+}
+
+func TestWriterPartialsInfo(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	data := randomData(t, 1024)
+	dgst := testDigest(t, data)
+
+	w, err := s.Writer(ctx, content.WithRef("info"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Looking up the info of the partial data records it, but does not make
+	// it committed content.
+	_, err = s.Info(ctx, dgst)
+	require.NoError(t, err)
+
+	err = s.Walk(ctx, func(info content.Info) error {
+		return errors.Errorf("unexpected content %s", info.Digest)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Abort(ctx, "info"))
+
+	c, err := digestconv.DigestToCid(dgst)
+	require.NoError(t, err)
+	require.False(t, backend.isPinned(c))
+}
+
+func TestWriterStalePartials(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	committed := randomData(t, 1024)
+	err = content.WriteBlob(ctx, s, "committed", bytes.NewReader(committed), ocispec.Descriptor{Size: int64(len(committed))})
+	require.NoError(t, err)
+
+	w, err := s.Writer(ctx, content.WithRef("stale"))
+	require.NoError(t, err)
+
+	_, err = w.Write(randomData(t, 1024))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 2)
+
+	// Ingests do not outlive the store, so their partial data is unpinned
+	// when it is reopened.
+	require.NoError(t, s.meta.db.Close())
+	s = newTestStore(t, backend, root)
+
+	pins, err = backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+	require.Equal(t, testDigest(t, committed), pinDigest(t, pins[0]))
+
+	partials, err := s.meta.partials()
+	require.NoError(t, err)
+	require.Empty(t, partials)
+}
+
+func TestWriterSharedPartials(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 4096)
+	dgst := testDigest(t, data)
+
+	// Two ingests of the same data share the pin of their partial data.
+	for _, ref := range []string{"shared-1", "shared-2"} {
+		w, err := s.Writer(ctx, content.WithRef(ref))
+		require.NoError(t, err)
+
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	c, err := digestconv.DigestToCid(dgst)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Abort(ctx, "shared-1"))
+	require.True(t, backend.isPinned(c))
+
+	w, err := s.Writer(ctx, content.WithRef("shared-2"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx, int64(len(data)), dgst))
+	require.True(t, backend.isPinned(c))
+
+	var walked []digest.Digest
+	err = s.Walk(ctx, func(info content.Info) error {
+		walked = append(walked, info.Digest)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []digest.Digest{dgst}, walked)
+}
+
+func TestWriterResumeTruncate(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1<<20)
+	dgst := testDigest(t, data)
+
+	w, err := s.Writer(ctx, content.WithRef("resume-truncate"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:1000])
+	require.NoError(t, err)
+	_, err = w.Write(randomData(t, 1000))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// A resumed writer can drop the bytes written after the good ones.
+	w, err = s.Writer(ctx, content.WithRef("resume-truncate"))
+	require.NoError(t, err)
+
+	status, err := w.Status()
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), status.Offset)
+
+	require.NoError(t, w.Truncate(1000))
+
+	_, err = w.Write(data[1000:])
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx, int64(len(data)), dgst))
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+	require.Equal(t, dgst, pinDigest(t, pins[0]))
+}
+
+func TestWriterResumeTotalMismatch(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	w, err := s.Writer(ctx, content.WithRef("total"), content.WithDescriptor(ocispec.Descriptor{Size: 2048}))
+	require.NoError(t, err)
+
+	_, err = w.Write(randomData(t, 1024))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, err = s.Writer(ctx, content.WithRef("total"), content.WithDescriptor(ocispec.Descriptor{Size: 4096}))
+	require.Error(t, err)
+
+	// The partial data is still there to be resumed.
+	status, err := s.Status(ctx, "total")
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), status.Offset)
+	require.Equal(t, int64(2048), status.Total)
+}
+
+// pinDigest returns the digest of the CID of pin.
+func pinDigest(t *testing.T, pin iface.Pin) digest.Digest {
+	dgst, err := digestconv.CidToDigest(pin.Path().Cid())
+	require.NoError(t, err)
+	return dgst
+}
+
+func TestWriterTruncate(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	data := randomData(t, 4096)
+
+	w, err := s.Writer(ctx, content.WithRef("truncate"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:3000])
+	require.NoError(t, err)
+
+	err = w.Truncate(5000)
+	require.True(t, errdefs.IsInvalidArgument(err))
+
+	require.NoError(t, w.Truncate(1000))
+
+	status, err := w.Status()
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), status.Offset)
+
+	_, err = w.Write(data[1000:])
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(data), w.Digest())
+
+	err = w.Commit(ctx, int64(len(data)), testDigest(t, data))
+	require.NoError(t, err)
+}
+
+func TestWriterLocked(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	w, err := s.Writer(ctx, content.WithRef("locked"))
+	require.NoError(t, err)
+
+	_, err = s.Writer(ctx, content.WithRef("locked"))
+	require.True(t, errdefs.IsUnavailable(err))
+
+	require.NoError(t, w.Close())
+
+	w, err = s.Writer(ctx, content.WithRef("locked"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestAbort(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	w, err := s.Writer(ctx, content.WithRef("abort"))
+	require.NoError(t, err)
+
+	_, err = w.Write(randomData(t, 1024))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.NoError(t, s.Abort(ctx, "abort"))
+
+	_, err = s.Status(ctx, "abort")
+	require.True(t, errdefs.IsNotFound(err))
+
+	err = s.Abort(ctx, "abort")
+	require.True(t, errdefs.IsNotFound(err))
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Empty(t, pins)
+}
+
+func TestListStatuses(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	before := time.Now()
+	for _, ref := range []string{"list-a-1", "list-a-2", "list-b-1"} {
+		w, err := s.Writer(ctx, content.WithRef(ref), content.WithDescriptor(ocispec.Descriptor{Size: 4096}))
+		require.NoError(t, err)
+		defer w.Close()
+
+		_, err = w.Write(randomData(t, 1024))
+		require.NoError(t, err)
+	}
+
+	status, err := s.Status(ctx, "list-a-1")
+	require.NoError(t, err)
+	require.Equal(t, "list-a-1", status.Ref)
+	require.Equal(t, int64(1024), status.Offset)
+	require.Equal(t, int64(4096), status.Total)
+	require.False(t, status.StartedAt.Before(before))
+	require.False(t, status.UpdatedAt.Before(status.StartedAt))
+
+	statuses, err := s.ListStatuses(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+
+	statuses, err = s.ListStatuses(ctx, `ref~="list-a-"`)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	for _, status := range statuses {
+		require.Contains(t, status.Ref, "list-a-")
+	}
+
+	_, err = s.ListStatuses(ctx, `ref~=`)
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+
+	_, err = s.Status(ctx, "list-c-1")
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+}
+
+func TestAbortOpenWriter(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	w, err := s.Writer(ctx, content.WithRef("abort-open"))
+	require.NoError(t, err)
+
+	_, err = w.Write(randomData(t, 1024))
+	require.NoError(t, err)
+
+	// The in-flight add is cancelled without the writer being closed first.
+	require.NoError(t, s.Abort(ctx, "abort-open"))
+
+	_, err = s.Status(ctx, "abort-open")
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	_, err = w.Write(randomData(t, 1024))
+	require.Error(t, err)
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Empty(t, pins)
+
+	// The ref can be reused right away.
+	w, err = s.Writer(ctx, content.WithRef("abort-open"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(newTestBackend())
+
+	const n = 16
+
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+
+	// Poll the ingests while the writers make progress.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			statuses, err := s.ListStatuses(ctx, `ref~="concurrent-"`)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, status := range statuses {
+				s.Status(ctx, status.Ref)
+			}
+		}
+	}()
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i := 0; i < n; i++ {
+		ref := fmt.Sprintf("concurrent-%d", i)
+		data := randomData(t, 64*1024*(i+1))
+		dgst := testDigest(t, data)
+
+		eg.Go(func() error {
+			w, err := s.Writer(egCtx, content.WithRef(ref))
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(w, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+
+			err = w.Commit(egCtx, int64(len(data)), dgst)
+			if err != nil {
+				return err
+			}
+
+			if w.Digest() != dgst {
+				return fmt.Errorf("unexpected digest %s, expected %s", w.Digest(), dgst)
+			}
+			return nil
+		})
+	}
+
+	err := eg.Wait()
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err)
+
+	statuses, err := s.ListStatuses(ctx)
+	require.NoError(t, err)
+	require.Empty(t, statuses)
+}
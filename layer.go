@@ -0,0 +1,382 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/hinshun/ipcs/digestconv"
+	files "github.com/ipfs/go-ipfs-files"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaTypeUnixfsLayer is the media type of a file-granular layer, whose
+	// descriptor points to its layer metadata.
+	MediaTypeUnixfsLayer = "application/vnd.ipcs.layer.v1.unixfs"
+
+	// whiteoutPrefix prefixes the names of the files that delete a file from
+	// the layers below, or make a directory opaque.
+	whiteoutPrefix = ".wh."
+)
+
+// LayerMetadata is the metadata sidecar of a file-granular layer. The files of
+// the layer are added to IPFS as a UnixFS directory, which keeps their names
+// and content but not the rest of their tar headers. So every tar header of the
+// layer is kept in the metadata in the order of the layer, including the ones
+// of entries that UnixFS cannot represent, such as hardlinks, device nodes and
+// whiteouts.
+type LayerMetadata struct {
+	MediaType string `json:"mediaType"`
+
+	// Root is the digest of the CID of the UnixFS directory of the layer.
+	Root digest.Digest `json:"root"`
+
+	// DiffID is the digest of the uncompressed layer the metadata was
+	// converted from.
+	DiffID digest.Digest `json:"diffID"`
+
+	Headers []*tar.Header `json:"headers"`
+}
+
+// ReadLayerMetadata reads the metadata of a file-granular layer specified by
+// its descriptor from provider.
+func ReadLayerMetadata(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (LayerMetadata, error) {
+	if desc.MediaType != MediaTypeUnixfsLayer {
+		return LayerMetadata{}, errors.Wrapf(errdefs.ErrInvalidArgument, "unexpected media type %q of layer %q", desc.MediaType, desc.Digest)
+	}
+
+	p, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return LayerMetadata{}, errors.Wrapf(err, "failed to read layer metadata %q", desc.Digest)
+	}
+
+	var meta LayerMetadata
+	err = json.Unmarshal(p, &meta)
+	if err != nil {
+		return LayerMetadata{}, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to unmarshal layer metadata %q: %v", desc.Digest, err)
+	}
+
+	if meta.MediaType != MediaTypeUnixfsLayer {
+		return LayerMetadata{}, errors.Wrapf(errdefs.ErrInvalidArgument, "unexpected media type %q of layer metadata %q", meta.MediaType, desc.Digest)
+	}
+
+	err = digestconv.Validate(meta.Root)
+	if err != nil {
+		return LayerMetadata{}, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid root of layer metadata %q: %v", desc.Digest, err)
+	}
+
+	return meta, nil
+}
+
+// copyLayer converts a layer specified by its descriptor to a file-granular
+// layer. The layer is decompressed and untarred into a temporary directory,
+// which is added to IPFS as individual files, so that files are deduplicated
+// across layers no matter where they are in the layer. The returned descriptor
+// points to the layer metadata.
+//
+// Only regular files, directories and symlinks are added to the directory,
+// since UnixFS does not support special files:
+// https://github.com/ipfs/go-ipfs/issues/1642
+func (c *converter) copyLayer(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var key string
+	if c.cache != nil {
+		var err error
+		key, err = addOptionsKey(c.addOpts)
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "invalid add options")
+		}
+		key += ",layer=unixfs"
+
+		if !c.force {
+			dgst, ok, err := c.cached(ctx, key, desc)
+			if err == nil && ok {
+				ok, err = c.cachedFiles(ctx, dgst)
+			}
+			if err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			if ok {
+				return c.layerDescriptor(ctx, desc, dgst)
+			}
+		}
+	}
+
+	isCompressed, err := images.IsCompressedDiff(ctx, desc.MediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "unsupported diff media type: %v", desc.MediaType)
+	}
+
+	ra, err := c.provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to create reader")
+	}
+	defer ra.Close()
+
+	var r io.Reader = content.NewReader(ra)
+	if isCompressed {
+		ds, err := compression.DecompressStream(r)
+		if err != nil {
+			return ocispec.Descriptor{}, errors.Wrap(err, "failed to decompress stream")
+		}
+		defer ds.Close()
+		r = ds
+	}
+
+	layer, _, err := addLayerFiles(ctx, r, c.addFile)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	layer.Annotations = desc.Annotations
+
+	if c.cache != nil {
+		err = c.cache.add(key, desc.Digest, conversion{Digest: layer.Digest, Size: ra.Size()})
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	return layer, nil
+}
+
+// addLayerFiles adds the tar stream r to IPFS as a file-granular layer. The
+// stream is untarred into a temporary directory, which is added with add along
+// with the layer metadata. It returns the descriptor and the contents of the
+// layer metadata.
+func addLayerFiles(ctx context.Context, r io.Reader, add func(context.Context, files.Node) (digest.Digest, error)) (ocispec.Descriptor, LayerMetadata, error) {
+	root, err := ioutil.TempDir("", "ipcs-layer")
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to create tmp root directory")
+	}
+	defer os.RemoveAll(root)
+
+	digester := digest.Canonical.Digester()
+	headers, err := untar(root, io.TeeReader(r, digester.Hash()))
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, err
+	}
+
+	stat, err := os.Lstat(root)
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to stat root")
+	}
+
+	n, err := files.NewSerialFile(root, true, stat)
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to create serial file out of root")
+	}
+
+	rootDigest, err := add(ctx, n)
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to upload layer directory")
+	}
+
+	meta := LayerMetadata{
+		MediaType: MediaTypeUnixfsLayer,
+		Root:      rootDigest,
+		DiffID:    digester.Digest(),
+		Headers:   headers,
+	}
+
+	metaJSON, err := json.MarshalIndent(&meta, "", "   ")
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to marshal layer metadata JSON")
+	}
+
+	dgst, err := add(ctx, files.NewBytesFile(metaJSON))
+	if err != nil {
+		return ocispec.Descriptor{}, LayerMetadata{}, errors.Wrap(err, "failed to upload layer metadata")
+	}
+
+	return ocispec.Descriptor{
+		MediaType: MediaTypeUnixfsLayer,
+		Digest:    dgst,
+		Size:      int64(len(metaJSON)),
+	}, meta, nil
+}
+
+// layerDescriptor returns the descriptor of the layer metadata at dgst that
+// the layer specified by desc was converted to before.
+func (c *converter) layerDescriptor(ctx context.Context, desc ocispec.Descriptor, dgst digest.Digest) (ocispec.Descriptor, error) {
+	root, err := digestconv.DigestToCid(dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "failed to convert digest %q to cid", dgst)
+	}
+
+	nd, err := c.backend.Dag().Get(ctx, root)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(ipfsError(err), "failed to get root node %q", root)
+	}
+
+	size, err := fileSize(nd)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return ocispec.Descriptor{
+		MediaType:   MediaTypeUnixfsLayer,
+		Digest:      dgst,
+		Size:        int64(size),
+		Annotations: desc.Annotations,
+	}, nil
+}
+
+// cachedFiles returns whether the files of a cached file-granular layer, whose
+// metadata has the digest dgst, are still in IPFS. The files are only referred
+// to by the metadata, so they are pinned again offline as well.
+func (c *converter) cachedFiles(ctx context.Context, dgst digest.Digest) (bool, error) {
+	offline, err := c.backend.Offline()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create offline ipfs backend")
+	}
+
+	cs, err := NewContentStoreFromBackend(offline)
+	if err != nil {
+		return false, err
+	}
+
+	meta, err := ReadLayerMetadata(ctx, cs, ocispec.Descriptor{MediaType: MediaTypeUnixfsLayer, Digest: dgst})
+	switch {
+	case errdefs.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	root, err := digestconv.DigestToCid(meta.Root)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to convert digest %q to cid", meta.Root)
+	}
+
+	return c.keepCached(ctx, offline, root)
+}
+
+// untar writes the regular files, directories and symlinks of the tar stream
+// r to root, and returns every tar header of r. The files are written with the
+// permissions of the current user rather than the ones of their headers, so
+// that root can always be read back and removed.
+func untar(root string, r io.Reader) ([]*tar.Header, error) {
+	var headers []*tar.Header
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read tar header")
+		}
+		headers = append(headers, hdr)
+
+		// Entries are kept inside root no matter their names.
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" || strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeRegA, tar.TypeSymlink:
+		default:
+			continue
+		}
+
+		p := filepath.Join(root, filepath.FromSlash(name))
+		err = mkdirParents(root, filepath.Dir(p))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create parents of %q", hdr.Name)
+		}
+
+		// A later entry replaces an earlier one of the same name, except that
+		// directories are merged.
+		fi, err := os.Lstat(p)
+		switch {
+		case err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir):
+			err = os.RemoveAll(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to replace %q", hdr.Name)
+			}
+		case err != nil && !os.IsNotExist(err):
+			return nil, errors.Wrapf(err, "failed to stat %q", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, p)
+		default:
+			err = writeFile(p, tr)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create %q", hdr.Name)
+		}
+	}
+
+	// Read any trailing data
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, errors.Wrap(err, "failed to discard trailing data after tar archive")
+	}
+
+	return headers, nil
+}
+
+// mkdirParents creates the directory dir inside root and its parents. Symlinks
+// are never followed, so that entries cannot be written outside of root, nor
+// end up at a different path in the directory than in the layer.
+func mkdirParents(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	p := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+
+		fi, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			err = os.Mkdir(p, 0755)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !fi.IsDir():
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "parent %q is not a directory", elem)
+		}
+	}
+
+	return nil
+}
+
+func writeFile(p string, r io.Reader) error {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
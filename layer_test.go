@@ -0,0 +1,218 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/hinshun/ipcs/digestconv"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testEntry is an entry of a test layer.
+type testEntry struct {
+	hdr  tar.Header
+	data []byte
+}
+
+// newTestLayer returns the tar stream of entries and its gzip compression.
+func newTestLayer(t *testing.T, entries ...testEntry) ([]byte, []byte) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		_, err := tw.Write(e.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err := zw.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes(), gz.Bytes()
+}
+
+func TestConvertUnixfsLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var (
+		modTime = time.Unix(1560000000, 0)
+		data    = randomData(t, 4096)
+	)
+	tarball, layer := newTestLayer(t,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0700, Uid: 1000, Gid: 1000, ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0600, Uid: 1000, ModTime: modTime, PAXRecords: map[string]string{"SCHILY.xattr.user.ipcs": "test"}}, data: data},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/.profile", Mode: 0644, ModTime: modTime}, data: []byte("export PS1='$ '\n")},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hostname.bak", Linkname: "etc/hostname", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "var/.wh.cache", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "tmp/.wh..wh..opq", ModTime: modTime}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644, ModTime: modTime}, data: []byte("contained")},
+	)
+
+	img := newTestImage(t, root, layer)
+
+	backend := NewMemoryBackend()
+	desc, err := NewConverter(backend, img.provider, WithUnixfsLayers()).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+	require.NoError(t, err)
+	require.Len(t, mfst.Layers, 1)
+	require.Equal(t, MediaTypeUnixfsLayer, mfst.Layers[0].MediaType)
+	require.Equal(t, img.manifest.Digest.String(), mfst.Annotations[AnnotationSourceDigest])
+
+	meta, err := ReadLayerMetadata(ctx, cs, mfst.Layers[0])
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(tarball), meta.DiffID)
+
+	// Every tar header is kept, with all of its fields.
+	require.Len(t, meta.Headers, 9)
+	require.Equal(t, int64(0700), meta.Headers[0].Mode)
+	require.Equal(t, 1000, meta.Headers[0].Gid)
+	require.Equal(t, "test", meta.Headers[1].PAXRecords["SCHILY.xattr.user.ipcs"])
+	require.True(t, modTime.Equal(meta.Headers[1].ModTime))
+	require.Equal(t, byte(tar.TypeLink), meta.Headers[4].Typeflag)
+	require.Equal(t, "etc/hostname", meta.Headers[4].Linkname)
+	require.Equal(t, int64(3), meta.Headers[5].Devminor)
+	require.Equal(t, "var/.wh.cache", meta.Headers[6].Name)
+
+	c, err := digestconv.DigestToCid(meta.Root)
+	require.NoError(t, err)
+	rootPath := path.IpfsPath(c)
+
+	for name, expected := range map[string][]byte{
+		"etc/hostname": data,
+		"etc/.profile": []byte("export PS1='$ '\n"),
+		"escape":       []byte("contained"),
+	} {
+		n, err := backend.Get(ctx, path.Join(rootPath, name))
+		require.NoError(t, err, name)
+
+		actual, err := ioutil.ReadAll(files.ToFile(n))
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, name)
+	}
+
+	n, err := backend.Get(ctx, path.Join(rootPath, "hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "etc/hostname", n.(*files.Symlink).Target)
+
+	// Only the metadata has the entries UnixFS cannot represent.
+	for _, name := range []string{"etc/hostname.bak", "dev/null", "dev", "var/.wh.cache", "tmp/.wh..wh..opq"} {
+		_, err = backend.Get(ctx, path.Join(rootPath, name))
+		require.True(t, errdefs.IsNotFound(ipfsError(err)), "%s: %v", name, err)
+	}
+}
+
+func TestConvertUnixfsLayersCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, layer := newTestLayer(t,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "data", Mode: 0644}, data: randomData(t, 4096)},
+	)
+	img := newTestImage(t, root, layer)
+
+	cc, err := OpenConversionCache(filepath.Join(root, "cache.db"))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	backend := NewMemoryBackend()
+	convert := func(opts ...ConverterOpt) ocispec.Descriptor {
+		desc, err := NewConverter(backend, img.provider, append(opts, WithConversionCache(cc))...).Convert(ctx, img.manifest)
+		require.NoError(t, err)
+
+		cs, err := NewContentStoreFromBackend(backend)
+		require.NoError(t, err)
+
+		mfst, err := images.Manifest(ctx, cs, desc, platforms.Default())
+		require.NoError(t, err)
+		return mfst.Layers[0]
+	}
+
+	unixfs := convert(WithUnixfsLayers())
+	require.Equal(t, MediaTypeUnixfsLayer, unixfs.MediaType)
+
+	// Layers are cached separately per format.
+	blob := convert()
+	require.Equal(t, ocispec.MediaTypeImageLayerGzip, blob.MediaType)
+	require.NotEqual(t, unixfs.Digest, blob.Digest)
+
+	require.Equal(t, unixfs, convert(WithUnixfsLayers()))
+
+	// The files of a cached layer are pinned again along with its metadata.
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	meta, err := ReadLayerMetadata(ctx, cs, unixfs)
+	require.NoError(t, err)
+
+	dir, err := digestconv.DigestToCid(meta.Root)
+	require.NoError(t, err)
+	require.NoError(t, backend.Unpin(ctx, path.IpfsPath(dir)))
+
+	require.Equal(t, unixfs, convert(WithUnixfsLayers()))
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+
+	var pinned bool
+	for _, pin := range pins {
+		pinned = pinned || pin.Path().Cid() == dir
+	}
+	require.True(t, pinned, "files %q are not pinned", dir)
+}
+
+func TestConvertUnixfsLayersSymlinkParent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	// Entries are never written through symlinks, which could point outside
+	// of the layer.
+	_, layer := newTestLayer(t,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc", Linkname: "/etc"}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/ipcs-test", Mode: 0644}, data: []byte("escaped")},
+	)
+	img := newTestImage(t, root, layer)
+
+	_, err = NewConverter(NewMemoryBackend(), img.provider, WithUnixfsLayers()).Convert(ctx, img.manifest)
+	require.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+
+	_, err = os.Stat("/etc/ipcs-test")
+	require.True(t, os.IsNotExist(err), "%v", err)
+}
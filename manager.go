@@ -2,43 +2,63 @@ package ipcs
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/labels"
 	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
+// walkConcurrency is the default number of pins whose info is looked up in
+// parallel during a Walk.
+const walkConcurrency = 16
+
 // Info will return metadata about content available in the content store.
 //
-// If the content is not present, ErrNotFound will be returned.
+// If the content is not present, ErrNotFound will be returned. Content is only
+// present if IPFS has it locally, even if it could be fetched from the network.
 func (s *store) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
-	c, err := digestconv.DigestToCid(dgst)
+	c, key, err := s.resolve(dgst)
 	if err != nil {
-		return content.Info{}, errors.Wrapf(err, "failed to convert digest %q to cid", dgst)
+		return content.Info{}, err
 	}
 
-	n, err := s.cln.Unixfs().Get(ctx, path.IpfsPath(c))
+	size, err := s.localSize(ctx, c)
 	if err != nil {
-		return content.Info{}, errors.Wrapf(err, "failed to get unixfs node %q", c)
+		return content.Info{}, err
+	}
+
+	info := content.Info{
+		Digest: dgst,
+		Size:   size,
 	}
 
-	size, err := n.Size()
+	if s.meta == nil {
+		now := time.Now()
+		info.CreatedAt = now
+		info.UpdatedAt = now
+		return info, nil
+	}
+
+	rec, err := s.meta.get(key)
 	if err != nil {
-		return content.Info{}, errors.Wrapf(err, "failed to get size of %q", c)
+		return content.Info{}, errors.Wrapf(err, "failed to get metadata of %q", dgst)
 	}
+	rec.apply(&info)
 
-	now := time.Now()
-	return content.Info{
-		Digest:    dgst,
-		Size:      size,
-		CreatedAt: now,
-		UpdatedAt: now,
-	}, nil
+	return info, nil
 }
 
 // Update updates mutable information related to content.
@@ -47,57 +67,308 @@ func (s *store) Info(ctx context.Context, dgst digest.Digest) (content.Info, err
 // Mutable fields:
 //  labels.*
 func (s *store) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
-	return content.Info{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "update not supported on immutable content store")
+	if s.meta == nil {
+		return content.Info{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "update not supported without a metadata root directory")
+	}
+
+	updated, err := s.Info(ctx, info.Digest)
+	if err != nil {
+		return content.Info{}, err
+	}
+
+	_, key, err := s.resolve(info.Digest)
+	if err != nil {
+		return content.Info{}, err
+	}
+
+	rec, err := s.meta.update(key, func(rec *contentRecord) error {
+		if len(fieldpaths) == 0 {
+			rec.Labels = copyLabels(info.Labels)
+		}
+
+		for _, path := range fieldpaths {
+			if strings.HasPrefix(path, "labels.") {
+				if rec.Labels == nil {
+					rec.Labels = make(map[string]string)
+				}
+
+				key := strings.TrimPrefix(path, "labels.")
+				rec.Labels[key] = info.Labels[key]
+				continue
+			}
+
+			switch path {
+			case "labels":
+				rec.Labels = copyLabels(info.Labels)
+			default:
+				return errors.Wrapf(errdefs.ErrInvalidArgument, "cannot update %q field on content info %q", path, info.Digest)
+			}
+		}
+
+		for k, v := range rec.Labels {
+			err := labels.Validate(k, v)
+			if err != nil {
+				return errors.Wrap(err, "info.Labels")
+			}
+		}
+
+		rec.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return content.Info{}, err
+	}
+	rec.apply(&updated)
+
+	return updated, nil
 }
 
 // Walk will call fn for each item in the content store which
 // match the provided filters. If no filters are given all
 // items will be walked.
-func (s *store) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
-	// TODO: Filters are also not supported in containerd's local store.
-	// Since we replace the local store, and filters are implemented in the boltdb
-	// metadata that wraps the local store, we can wait until upstream supports
-	// it too.
-
-	pins, err := s.cln.Pin().Ls(ctx, options.Pin.Type.All())
+func (s *store) Walk(ctx context.Context, fn content.WalkFunc, fs ...string) error {
+	filter, err := filters.ParseAll(fs...)
 	if err != nil {
-		return errors.Wrap(err, "failed to list ipfs pins")
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "failed to parse filters: %v", err)
 	}
 
-	for _, pin := range pins {
-		c := pin.Path().Cid()
-		dgst, err := digestconv.CidToDigest(c)
+	// Indirect pins are the blocks that make up content, so only recursive and
+	// direct pins are content themselves.
+	var pins []iface.Pin
+	for _, pinType := range []options.PinLsOption{options.Pin.Type.Recursive(), options.Pin.Type.Direct()} {
+		ps, err := s.backend.Pins(ctx, pinType)
 		if err != nil {
-			return errors.Wrap(err, "failed to convert digest")
+			return errors.Wrap(ipfsError(err), "failed to list ipfs pins")
 		}
+		pins = append(pins, ps...)
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	dgsts := make(chan digest.Digest)
+	infos := make(chan content.Info)
+
+	eg.Go(func() error {
+		defer close(dgsts)
+		for _, pin := range pins {
+			// The partial data of ingests is pinned, but it is not content.
+			partial, err := s.isPartial(pin.Path().Cid())
+			if err != nil {
+				return err
+			}
+			if partial {
+				continue
+			}
+
+			walked, err := s.walkDigests(pin.Path().Cid())
+			if err != nil {
+				return err
+			}
+
+			for _, dgst := range walked {
+				select {
+				case dgsts <- dgst:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+
+	// Info may need to reach the network, so the lookups of several pins are
+	// done in parallel.
+	var wg sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		eg.Go(func() error {
+			defer wg.Done()
+			for dgst := range dgsts {
+				// Directories such as the roots of unixfs layers are pinned, but
+				// they are not blobs.
+				info, ok, err := s.matchInfo(ctx, dgst, filter)
+				if errdefs.IsNotImplemented(err) {
+					continue
+				}
+				if err != nil {
+					return errors.Wrap(err, "failed to get info")
+				}
 
-		info, err := s.Info(ctx, dgst)
+				if !ok {
+					continue
+				}
+
+				select {
+				case infos <- info:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(infos)
+	}()
+
+	eg.Go(func() error {
+		for info := range infos {
+			err := fn(info)
+			if err != nil {
+				return errors.Wrap(err, "failed to walk info")
+			}
+		}
+		return nil
+	})
+
+	return eg.Wait()
+}
+
+// walkDigests returns the digests that the content pinned at c is walked by,
+// which are the digests it was committed by, so that they match the digests
+// containerd references it by. Content that was never committed through the
+// store is walked by the digest of its CID.
+func (s *store) walkDigests(c cid.Cid) ([]digest.Digest, error) {
+	dgst, err := digestconv.CidToDigest(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert digest")
+	}
+
+	if s.meta == nil {
+		return []digest.Digest{dgst}, nil
+	}
+
+	rec, err := s.meta.lookup(dgst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up metadata of %q", dgst)
+	}
+
+	if len(rec.Digests) == 0 {
+		return []digest.Digest{dgst}, nil
+	}
+	return rec.Digests, nil
+}
+
+// matchInfo returns the info of dgst if it matches filter. Digest and labels
+// are matched first, so that the info is only looked up for content that can
+// still match.
+func (s *store) matchInfo(ctx context.Context, dgst digest.Digest, filter filters.Filter) (content.Info, bool, error) {
+	var rec contentRecord
+	if s.meta != nil {
+		key, err := s.meta.resolve(dgst)
 		if err != nil {
-			return errors.Wrap(err, "failed to get info")
+			return content.Info{}, false, errors.Wrapf(err, "failed to resolve alias %q", dgst)
 		}
 
-		err = fn(info)
+		rec, err = s.meta.lookup(key)
 		if err != nil {
-			return errors.Wrap(err, "failed to walk info")
+			return content.Info{}, false, errors.Wrapf(err, "failed to get metadata of %q", dgst)
 		}
 	}
 
-	return nil
+	var (
+		info    content.Info
+		infoErr error
+		loaded  bool
+	)
+	load := func() {
+		if !loaded {
+			info, infoErr = s.Info(ctx, dgst)
+			loaded = true
+		}
+	}
+
+	matched := filter.Match(filters.AdapterFunc(func(fieldpath []string) (string, bool) {
+		if len(fieldpath) == 0 {
+			return "", false
+		}
+
+		switch fieldpath[0] {
+		case "digest":
+			return dgst.String(), true
+		case "size":
+			load()
+			if infoErr != nil {
+				return "", false
+			}
+			return strconv.FormatInt(info.Size, 10), true
+		case "labels":
+			if len(rec.Labels) == 0 {
+				return "", false
+			}
+
+			value, ok := rec.Labels[strings.Join(fieldpath[1:], ".")]
+			return value, ok
+		}
+
+		return "", false
+	}))
+	if !matched {
+		return content.Info{}, false, infoErr
+	}
+
+	load()
+	return info, infoErr == nil, infoErr
 }
 
 // Delete removes the content from the store.
 func (s *store) Delete(ctx context.Context, dgst digest.Digest) error {
-	c, err := digestconv.DigestToCid(dgst)
+	c, key, err := s.resolve(dgst)
 	if err != nil {
-		return errors.Wrap(err, "failed to convert digest")
+		return err
+	}
+
+	if s.meta != nil {
+		rec, err := s.meta.lookup(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up metadata of %q", dgst)
+		}
+
+		// Content that is still known by other digests stays pinned, so only
+		// the deleted digest is forgotten.
+		if containsDigest(rec.Digests, dgst) && len(rec.Digests) > 1 {
+			err = s.meta.removeDigest(key, dgst)
+			if err != nil {
+				return errors.Wrapf(err, "failed to delete metadata of %q", dgst)
+			}
+			return nil
+		}
 	}
 
 	// Recursively removing a pin will not remove shared chunks because IPFS has
 	// its internal refcounting. This will expose the unpinned blobs to IPFS GC.
-	err = s.cln.Pin().Rm(ctx, path.IpfsPath(c), options.Pin.RmRecursive(true))
-	if err != nil {
-		return errors.Wrap(err, "failed to remove pin")
+	// Content is not pinned at all by a store that does not pin it.
+	if s.pinMode != PinNone {
+		err = s.backend.Unpin(ctx, path.IpfsPath(c), options.Pin.RmRecursive(true))
+		if err != nil {
+			return errors.Wrapf(ipfsError(err), "failed to remove pin of %q", dgst)
+		}
+
+		err = s.unpinDirs(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.meta != nil {
+		err = s.meta.delete(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete metadata of %q", dgst)
+		}
 	}
 
 	return nil
 }
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,320 @@
+package ipcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/hinshun/ipcs/digestconv"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T, backend *testBackend, root string) *store {
+	cs, err := NewContentStoreFromBackend(backend, WithRootDir(root))
+	require.NoError(t, err)
+	return cs.(*store)
+}
+
+func TestInfoPersistsMetadata(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	data := randomData(t, 1024)
+	dgst := testDigest(t, data)
+
+	before := time.Now().UTC()
+	w, err := s.Writer(ctx, content.WithRef("labels"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+
+	labels := map[string]string{"containerd.io/gc.root": "true"}
+	err = w.Commit(ctx, int64(len(data)), dgst, content.WithLabels(labels))
+	require.NoError(t, err)
+
+	info, err := s.Info(ctx, dgst)
+	require.NoError(t, err)
+	require.Equal(t, labels, info.Labels)
+	require.False(t, info.CreatedAt.Before(before))
+
+	// Reopening the metadata index keeps the stored values.
+	require.NoError(t, s.meta.db.Close())
+	s = newTestStore(t, backend, root)
+
+	reopened, err := s.Info(ctx, dgst)
+	require.NoError(t, err)
+	require.Equal(t, info, reopened)
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+	desc := addTestFile(t, backend, randomData(t, 1024))
+
+	info, err := s.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels)
+
+	updated, err := s.Update(ctx, content.Info{
+		Digest: desc.Digest,
+		Labels: map[string]string{"foo": "1", "bar": "2"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"foo": "1", "bar": "2"}, updated.Labels)
+	require.Equal(t, info.CreatedAt, updated.CreatedAt)
+	require.True(t, updated.UpdatedAt.After(info.UpdatedAt))
+
+	// Only the given fieldpaths are updated, and empty labels are removed.
+	updated, err = s.Update(ctx, content.Info{
+		Digest: desc.Digest,
+		Labels: map[string]string{"foo": "", "bar": "ignored", "baz": "3"},
+	}, "labels.foo", "labels.baz")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"bar": "2", "baz": "3"}, updated.Labels)
+
+	_, err = s.Update(ctx, content.Info{Digest: desc.Digest, Size: 1}, "size")
+	require.True(t, errdefs.IsInvalidArgument(err))
+
+	info, err = s.Info(ctx, desc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, updated, info)
+}
+
+func TestWalkFilters(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	var descs []ocispec.Descriptor
+	for i := 0; i < 64; i++ {
+		desc := addTestFile(t, backend, randomData(t, 512*(i%4+1)))
+		descs = append(descs, desc)
+
+		if i%2 == 0 {
+			_, err := s.Update(ctx, content.Info{
+				Digest: desc.Digest,
+				Labels: map[string]string{"parity": "even"},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	walk := func(fs ...string) map[digest.Digest]content.Info {
+		infos := make(map[digest.Digest]content.Info)
+		err := s.Walk(ctx, func(info content.Info) error {
+			infos[info.Digest] = info
+			return nil
+		}, fs...)
+		require.NoError(t, err)
+		return infos
+	}
+
+	require.Len(t, walk(), len(descs))
+	require.Len(t, walk(`labels.parity==even`), len(descs)/2)
+	require.Len(t, walk(`size==1024`), len(descs)/4)
+	require.Len(t, walk(`labels.parity==even,size==1536`), len(descs)/4)
+	require.Len(t, walk(`labels.parity==even`, `size==1024`), len(descs)/2+len(descs)/4)
+
+	infos := walk(fmt.Sprintf("digest==%s", descs[3].Digest))
+	require.Len(t, infos, 1)
+	require.Equal(t, descs[3].Size, infos[descs[3].Digest].Size)
+
+	err = s.Walk(ctx, func(content.Info) error {
+		return nil
+	}, `labels.parity==`)
+	require.True(t, errdefs.IsInvalidArgument(err))
+
+	// Errors from fn stop the walk.
+	errStop := errors.New("stop")
+	err = s.Walk(ctx, func(content.Info) error {
+		return errStop
+	})
+	require.Equal(t, errStop, errors.Cause(err))
+}
+
+func TestAliases(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	data := randomData(t, 1<<20)
+	dgst := testDigest(t, data)
+	alias := digest.FromBytes(data)
+
+	w, err := s.Writer(ctx, content.WithRef("alias"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[:1000])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Resuming keeps digesting from where the writer left off.
+	w, err = s.Writer(ctx, content.WithRef("alias"))
+	require.NoError(t, err)
+
+	_, err = w.Write(data[1000:])
+	require.NoError(t, err)
+	require.Equal(t, alias, w.Digest())
+
+	err = w.Commit(ctx, int64(len(data)), alias, content.WithLabels(map[string]string{"foo": "bar"}))
+	require.NoError(t, err)
+	require.Equal(t, alias, w.Digest())
+
+	_, err = s.Writer(ctx, content.WithRef("exists"), content.WithDescriptor(ocispec.Descriptor{Digest: alias}))
+	require.True(t, errdefs.IsAlreadyExists(err))
+
+	for _, d := range []digest.Digest{dgst, alias} {
+		info, err := s.Info(ctx, d)
+		require.NoError(t, err)
+		require.Equal(t, d, info.Digest)
+		require.Equal(t, int64(len(data)), info.Size)
+		require.Equal(t, "bar", info.Labels["foo"])
+
+		p, err := content.ReadBlob(ctx, s, ocispec.Descriptor{Digest: d})
+		require.NoError(t, err)
+		require.Equal(t, data, p)
+	}
+
+	require.NoError(t, s.Delete(ctx, alias))
+
+	rec, err := s.meta.lookup(dgst)
+	require.NoError(t, err)
+	require.True(t, rec.CreatedAt.IsZero())
+
+	resolved, err := s.meta.resolve(alias)
+	require.NoError(t, err)
+	require.Equal(t, alias, resolved)
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Empty(t, pins)
+}
+
+func TestWalkCommittedDigests(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := newTestStore(t, backend, root)
+
+	walk := func() []digest.Digest {
+		var dgsts []digest.Digest
+		err := s.Walk(ctx, func(info content.Info) error {
+			dgsts = append(dgsts, info.Digest)
+			return nil
+		})
+		require.NoError(t, err)
+		return dgsts
+	}
+
+	// Content committed by its sha256 is walked by it rather than its CID, so
+	// that containerd finds it referenced.
+	data := randomData(t, 1<<20)
+	dgst := testDigest(t, data)
+	alias := digest.FromBytes(data)
+	require.NoError(t, content.WriteBlob(ctx, s, "sha256", bytes.NewReader(data), ocispec.Descriptor{Digest: alias, Size: int64(len(data))}))
+	require.Equal(t, []digest.Digest{alias}, walk())
+
+	// Content committed by its CID is walked by it.
+	other := randomData(t, 1<<10)
+	otherDgst := testDigest(t, other)
+	require.NoError(t, content.WriteBlob(ctx, s, "cid", bytes.NewReader(other), ocispec.Descriptor{Digest: otherDgst, Size: int64(len(other))}))
+	require.ElementsMatch(t, []digest.Digest{alias, otherDgst}, walk())
+
+	// Content that already exists is also known by the digest it is written
+	// by.
+	_, err = s.Writer(ctx, content.WithRef("exists"), content.WithDescriptor(ocispec.Descriptor{Digest: dgst}))
+	require.True(t, errdefs.IsAlreadyExists(err), "%v", err)
+	require.ElementsMatch(t, []digest.Digest{alias, dgst, otherDgst}, walk())
+
+	// Deleting one of the digests of content keeps it pinned for the others.
+	require.NoError(t, s.Delete(ctx, alias))
+	require.ElementsMatch(t, []digest.Digest{dgst, otherDgst}, walk())
+
+	_, err = s.Info(ctx, alias)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	info, err := s.Info(ctx, dgst)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+
+	require.NoError(t, s.Delete(ctx, dgst))
+	require.Equal(t, []digest.Digest{otherDgst}, walk())
+}
+
+func TestWalkSkipsDirectories(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1<<10)
+	desc := addTestFile(t, backend, data)
+
+	dir := files.NewMapDirectory(map[string]files.Node{
+		"file": files.NewBytesFile(data),
+	})
+	p, err := backend.Add(ctx, dir, options.Unixfs.Pin(true))
+	require.NoError(t, err)
+
+	dirDgst, err := digestconv.CidToDigest(p.Cid())
+	require.NoError(t, err)
+
+	// A pinned directory is not a blob, but does not keep the blobs from
+	// being walked, whether or not they are filtered by size.
+	for _, fs := range [][]string{nil, {fmt.Sprintf("size==%d", len(data))}} {
+		var dgsts []digest.Digest
+		err = s.Walk(ctx, func(info content.Info) error {
+			dgsts = append(dgsts, info.Digest)
+			return nil
+		}, fs...)
+		require.NoError(t, err)
+		require.Equal(t, []digest.Digest{desc.Digest}, dgsts)
+	}
+
+	_, err = s.Info(ctx, dirDgst)
+	require.True(t, errdefs.IsNotImplemented(err), "%v", err)
+}
+
+func TestInfoInvalidDigest(t *testing.T) {
+	s := newStore(newTestBackend())
+
+	_, err := s.Info(context.Background(), "md5:d41d8cd98f00b204e9800998ecf8427e")
+	require.True(t, errdefs.IsInvalidArgument(err))
+}
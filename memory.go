@@ -0,0 +1,347 @@
+package ipcs
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	blockservice "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
+	uio "github.com/ipfs/go-unixfs/io"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/pkg/errors"
+)
+
+// Pin types, as listed by IPFS.
+const (
+	pinTypeRecursive = "recursive"
+	pinTypeDirect    = "direct"
+	pinTypeIndirect  = "indirect"
+)
+
+type memoryBackend struct {
+	dag ipld.DAGService
+
+	mu   sync.Mutex
+	pins map[cid.Cid]string
+}
+
+// NewMemoryBackend returns a backend that keeps everything in memory. It has
+// no network, so it only ever has the content added to it.
+func NewMemoryBackend() Backend {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	return &memoryBackend{
+		dag:  merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		pins: make(map[cid.Cid]string),
+	}
+}
+
+func (b *memoryBackend) Add(ctx context.Context, n files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error) {
+	settings, prefix, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only hashing content adds it to a DAG that is thrown away.
+	dag := b.dag
+	if settings.OnlyHash {
+		bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+		dag = merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	}
+
+	nd, err := b.add(ctx, dag, n, settings, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Pin && !settings.OnlyHash {
+		b.mu.Lock()
+		b.pins[nd.Cid()] = pinTypeRecursive
+		b.mu.Unlock()
+	}
+
+	return path.IpfsPath(nd.Cid()), nil
+}
+
+func (b *memoryBackend) add(ctx context.Context, dag ipld.DAGService, n files.Node, settings *options.UnixfsAddSettings, prefix cid.Prefix) (ipld.Node, error) {
+	switch n := n.(type) {
+	case *files.Symlink:
+		data, err := unixfs.SymlinkData(n.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		nd := merkledag.NodeWithData(data)
+		nd.SetCidBuilder(prefix)
+		err = dag.Add(ctx, nd)
+		if err != nil {
+			return nil, err
+		}
+		return nd, nil
+	case files.File:
+		spl, err := chunker.FromString(n, settings.Chunker)
+		if err != nil {
+			return nil, err
+		}
+
+		dbp := helpers.DagBuilderParams{
+			Dagserv:    dag,
+			Maxlinks:   helpers.DefaultLinksPerBlock,
+			RawLeaves:  settings.RawLeaves,
+			CidBuilder: prefix,
+		}
+		db, err := dbp.New(spl)
+		if err != nil {
+			return nil, err
+		}
+
+		if settings.Layout == options.TrickleLayout {
+			return trickle.Layout(db)
+		}
+		return balanced.Layout(db)
+	case files.Directory:
+		dir := uio.NewDirectory(dag)
+		dir.SetCidBuilder(prefix)
+
+		entries := n.Entries()
+		for entries.Next() {
+			child, err := b.add(ctx, dag, entries.Node(), settings, prefix)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to add %q", entries.Name())
+			}
+
+			err = dir.AddChild(ctx, entries.Name(), child)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if entries.Err() != nil {
+			return nil, entries.Err()
+		}
+
+		nd, err := dir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+
+		err = dag.Add(ctx, nd)
+		if err != nil {
+			return nil, err
+		}
+		return nd, nil
+	default:
+		return nil, errors.Errorf("unsupported node type %T", n)
+	}
+}
+
+func (b *memoryBackend) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	nd, err := b.resolve(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return unixfile.NewUnixfsFile(ctx, b.dag, nd)
+}
+
+func (b *memoryBackend) Pin(ctx context.Context, p path.Path, opts ...options.PinAddOption) error {
+	settings, err := options.PinAddOptions(opts...)
+	if err != nil {
+		return err
+	}
+
+	nd, err := b.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	pinType := pinTypeDirect
+	if settings.Recursive {
+		pinType = pinTypeRecursive
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A recursive pin is not weakened by pinning directly.
+	if b.pins[nd.Cid()] != pinTypeRecursive {
+		b.pins[nd.Cid()] = pinType
+	}
+	return nil
+}
+
+func (b *memoryBackend) Unpin(ctx context.Context, p path.Path, opts ...options.PinRmOption) error {
+	settings, err := options.PinRmOptions(opts...)
+	if err != nil {
+		return err
+	}
+
+	c, err := b.resolveCid(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.pins[c] {
+	case pinTypeRecursive:
+		if !settings.Recursive {
+			return errors.Errorf("%s is pinned recursively", c)
+		}
+	case pinTypeDirect:
+	default:
+		return errors.Errorf("%s is not pinned", c)
+	}
+
+	delete(b.pins, c)
+	return nil
+}
+
+func (b *memoryBackend) Pins(ctx context.Context, opts ...options.PinLsOption) ([]iface.Pin, error) {
+	settings, err := options.PinLsOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	pins := make(map[cid.Cid]string, len(b.pins))
+	for c, pinType := range b.pins {
+		pins[c] = pinType
+	}
+	b.mu.Unlock()
+
+	var ls []iface.Pin
+	switch settings.Type {
+	case "all", pinTypeRecursive, pinTypeDirect:
+		for c, pinType := range pins {
+			if settings.Type == "all" || settings.Type == pinType {
+				ls = append(ls, memoryPin{path.IpfsPath(c), pinType})
+			}
+		}
+	}
+
+	switch settings.Type {
+	case "all", pinTypeIndirect:
+		indirect := cid.NewSet()
+		for c, pinType := range pins {
+			if pinType != pinTypeRecursive {
+				continue
+			}
+
+			err = merkledag.EnumerateChildren(ctx, merkledag.GetLinksWithDAG(b.dag), c, indirect.Visit)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = indirect.ForEach(func(c cid.Cid) error {
+			if _, ok := pins[c]; !ok {
+				ls = append(ls, memoryPin{path.IpfsPath(c), pinTypeIndirect})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ls, nil
+}
+
+func (b *memoryBackend) Dag() ipld.NodeGetter {
+	return b.dag
+}
+
+func (b *memoryBackend) Offline() (Backend, error) {
+	return b, nil
+}
+
+// resolve returns the node at p, following the names in p through
+// directories.
+func (b *memoryBackend) resolve(ctx context.Context, p path.Path) (ipld.Node, error) {
+	var (
+		root cid.Cid
+		rest string
+	)
+	if resolved, ok := p.(path.Resolved); ok {
+		root, rest = resolved.Cid(), resolved.Remainder()
+	} else {
+		parts := strings.SplitN(strings.TrimPrefix(p.String(), "/"), "/", 3)
+		if len(parts) < 2 || parts[0] != "ipfs" {
+			return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "unsupported path %q", p)
+		}
+
+		var err error
+		root, err = cid.Decode(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid path %q: %v", p, err)
+		}
+		if len(parts) == 3 {
+			rest = parts[2]
+		}
+	}
+
+	nd, err := b.dag.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(rest, "/") {
+		if name == "" {
+			continue
+		}
+
+		lnk, _, err := nd.ResolveLink([]string{name})
+		if err != nil {
+			return nil, errors.Wrapf(err, "no link named %q under %s", name, nd.Cid())
+		}
+
+		nd, err = lnk.GetNode(ctx, b.dag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nd, nil
+}
+
+func (b *memoryBackend) resolveCid(ctx context.Context, p path.Path) (cid.Cid, error) {
+	if resolved, ok := p.(path.Resolved); ok && resolved.Remainder() == "" {
+		return resolved.Cid(), nil
+	}
+
+	nd, err := b.resolve(ctx, p)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	return nd.Cid(), nil
+}
+
+type memoryPin struct {
+	path    path.Resolved
+	pinType string
+}
+
+func (p memoryPin) Path() path.Resolved {
+	return p.path
+}
+
+func (p memoryPin) Type() string {
+	return p.pinType
+}
@@ -0,0 +1,125 @@
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBackendFiles(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+
+	data := randomData(t, 1<<20)
+	p, err := backend.Add(ctx, files.NewBytesFile(data))
+	require.NoError(t, err)
+
+	n, err := backend.Get(ctx, p)
+	require.NoError(t, err)
+
+	actual, err := ioutil.ReadAll(files.ToFile(n))
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+
+	// Only hashing content gives its path without adding it.
+	other := randomData(t, 1024)
+	p, err = backend.Add(ctx, files.NewBytesFile(other), options.Unixfs.HashOnly(true))
+	require.NoError(t, err)
+
+	_, err = backend.Get(ctx, p)
+	require.True(t, errdefs.IsNotFound(ipfsError(err)), "%v", err)
+
+	// The layout changes the DAG, and so its root.
+	balanced, err := backend.Add(ctx, files.NewBytesFile(data), options.Unixfs.HashOnly(true))
+	require.NoError(t, err)
+
+	trickle, err := backend.Add(ctx, files.NewBytesFile(data), options.Unixfs.HashOnly(true), options.Unixfs.Layout(options.TrickleLayout))
+	require.NoError(t, err)
+	require.NotEqual(t, balanced.Cid(), trickle.Cid())
+}
+
+func TestMemoryBackendDirectory(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+
+	data := randomData(t, 4096)
+	dir := files.NewMapDirectory(map[string]files.Node{
+		"etc": files.NewMapDirectory(map[string]files.Node{
+			"hostname": files.NewBytesFile(data),
+		}),
+		"hosts": files.NewLinkFile("etc/hostname", nil),
+	})
+
+	p, err := backend.Add(ctx, dir)
+	require.NoError(t, err)
+
+	n, err := backend.Get(ctx, path.Join(p, "etc", "hostname"))
+	require.NoError(t, err)
+
+	actual, err := ioutil.ReadAll(files.ToFile(n))
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+
+	n, err = backend.Get(ctx, path.New(p.String()+"/hosts"))
+	require.NoError(t, err)
+	require.Equal(t, "etc/hostname", n.(*files.Symlink).Target)
+
+	_, err = backend.Get(ctx, path.Join(p, "missing"))
+	require.True(t, errdefs.IsNotFound(ipfsError(err)), "%v", err)
+}
+
+func TestMemoryBackendPins(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+
+	recursive, err := backend.Add(ctx, files.NewBytesFile(randomData(t, 1<<20)), options.Unixfs.Pin(true))
+	require.NoError(t, err)
+
+	direct, err := backend.Add(ctx, files.NewBytesFile(randomData(t, 1024)))
+	require.NoError(t, err)
+	require.NoError(t, backend.Pin(ctx, direct, options.Pin.Recursive(false)))
+
+	// Pinning directly does not weaken a recursive pin.
+	require.NoError(t, backend.Pin(ctx, recursive, options.Pin.Recursive(false)))
+
+	pins, err := backend.Pins(ctx, options.Pin.Type.Recursive())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+	require.Equal(t, recursive.Cid(), pins[0].Path().Cid())
+
+	pins, err = backend.Pins(ctx, options.Pin.Type.Direct())
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+	require.Equal(t, direct.Cid(), pins[0].Path().Cid())
+
+	nd, err := backend.Dag().Get(ctx, recursive.Cid())
+	require.NoError(t, err)
+
+	pins, err = backend.Pins(ctx, options.Pin.Type.Indirect())
+	require.NoError(t, err)
+	require.Len(t, pins, len(nd.Links()))
+
+	pins, err = backend.Pins(ctx)
+	require.NoError(t, err)
+	require.Len(t, pins, len(nd.Links())+2)
+
+	// A recursive pin is only removed recursively.
+	err = backend.Unpin(ctx, recursive, options.Pin.RmRecursive(false))
+	require.Error(t, err)
+	require.NoError(t, backend.Unpin(ctx, recursive))
+
+	err = backend.Unpin(ctx, recursive)
+	require.True(t, errdefs.IsNotFound(ipfsError(err)), "%v", err)
+
+	require.NoError(t, backend.Unpin(ctx, direct))
+
+	pins, err = backend.Pins(ctx)
+	require.NoError(t, err)
+	require.Empty(t, pins)
+}
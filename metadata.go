@@ -0,0 +1,386 @@
+package ipcs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketKeyContent  = []byte("content")
+	bucketKeyAliases  = []byte("aliases")
+	bucketKeyPartials = []byte("partials")
+	bucketKeyPins     = []byte("pins")
+)
+
+// metadata is a local index of the mutable information about content, which
+// IPFS has no place to keep.
+type metadata struct {
+	db *bolt.DB
+}
+
+// contentRecord is the information kept for a digest in the metadata index.
+// Records are keyed by the digest of the CID of the content.
+type contentRecord struct {
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+
+	// Aliases are the other digests the content is known by, such as the
+	// sha256 of its bytes.
+	Aliases []digest.Digest `json:"aliases,omitempty"`
+
+	// Digests are the digests the content was committed by, or found to
+	// exist by, through the store, which are the digests it is walked by.
+	Digests []digest.Digest `json:"digests,omitempty"`
+
+	// Pins are the digests of the directories pinned on behalf of the
+	// content, such as the files of a file-granular layer on behalf of its
+	// metadata.
+	Pins []digest.Digest `json:"pins,omitempty"`
+}
+
+// openMetadata opens or creates the metadata index at path.
+func openMetadata(path string) (*metadata, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open metadata db %q", path)
+	}
+
+	return newMetadata(db)
+}
+
+func newMetadata(db *bolt.DB) (*metadata, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, key := range [][]byte{bucketKeyContent, bucketKeyAliases, bucketKeyPartials, bucketKeyPins} {
+			_, err := tx.CreateBucketIfNotExists(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create metadata buckets")
+	}
+
+	return &metadata{db: db}, nil
+}
+
+// lookup returns the record of dgst, which is empty if there is none yet.
+func (m *metadata) lookup(dgst digest.Digest) (contentRecord, error) {
+	var rec contentRecord
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = readRecord(tx, dgst)
+		return err
+	})
+	return rec, err
+}
+
+// get returns the record of dgst, creating it if there is none yet so that
+// content added outside of ipcs gets a stable creation time.
+func (m *metadata) get(dgst digest.Digest) (contentRecord, error) {
+	rec, err := m.lookup(dgst)
+	if err != nil || !rec.CreatedAt.IsZero() {
+		return rec, err
+	}
+
+	// Creating records is batched, since a Walk may create many of them
+	// concurrently.
+	err = m.db.Batch(func(tx *bolt.Tx) error {
+		rec, err = readRecord(tx, dgst)
+		if err != nil || !rec.CreatedAt.IsZero() {
+			return err
+		}
+
+		now := time.Now().UTC()
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+		return writeRecord(tx, dgst, rec)
+	})
+	return rec, err
+}
+
+// update applies fn to the record of dgst and stores the result. A new record
+// is created if there is none yet.
+func (m *metadata) update(dgst digest.Digest, fn func(*contentRecord) error) (contentRecord, error) {
+	var rec contentRecord
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = readRecord(tx, dgst)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+			rec.UpdatedAt = now
+		}
+
+		err = fn(&rec)
+		if err != nil {
+			return err
+		}
+
+		for k, v := range rec.Labels {
+			if v == "" {
+				delete(rec.Labels, k)
+			}
+		}
+
+		return writeRecord(tx, dgst, rec)
+	})
+	return rec, err
+}
+
+// delete removes the record of dgst and its aliases.
+func (m *metadata) delete(dgst digest.Digest) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		rec, err := readRecord(tx, dgst)
+		if err != nil {
+			return err
+		}
+
+		for _, alias := range rec.Aliases {
+			err = tx.Bucket(bucketKeyAliases).Delete([]byte(alias))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(bucketKeyContent).Delete([]byte(dgst))
+	})
+}
+
+// resolve returns the digest that alias is an alias of, or alias itself if it
+// is not an alias.
+func (m *metadata) resolve(alias digest.Digest) (digest.Digest, error) {
+	dgst := alias
+	err := m.db.View(func(tx *bolt.Tx) error {
+		target := tx.Bucket(bucketKeyAliases).Get([]byte(alias))
+		if target != nil {
+			dgst = digest.Digest(target)
+		}
+		return nil
+	})
+	return dgst, err
+}
+
+// addAlias records alias as another digest of the content at dgst.
+func (m *metadata) addAlias(dgst, alias digest.Digest) error {
+	if alias == dgst {
+		return nil
+	}
+
+	_, err := m.update(dgst, func(rec *contentRecord) error {
+		for _, a := range rec.Aliases {
+			if a == alias {
+				return nil
+			}
+		}
+		rec.Aliases = append(rec.Aliases, alias)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyAliases).Put([]byte(alias), []byte(dgst))
+	})
+}
+
+// addPartial records that dgst is pinned as the partial data of an ingest.
+func (m *metadata) addPartial(dgst digest.Digest) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyPartials).Put([]byte(dgst), []byte{})
+	})
+}
+
+// removePartial forgets that dgst is pinned as the partial data of an ingest.
+func (m *metadata) removePartial(dgst digest.Digest) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyPartials).Delete([]byte(dgst))
+	})
+}
+
+// partials returns the digests pinned as the partial data of ingests.
+func (m *metadata) partials() ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyPartials).ForEach(func(k, _ []byte) error {
+			dgsts = append(dgsts, digest.Digest(k))
+			return nil
+		})
+	})
+	return dgsts, err
+}
+
+// addPin records that the directory at dir is pinned on behalf of the content
+// at dgst. Directories are indexed by the content they are pinned for, so that
+// they stay pinned as long as any of it is left.
+func (m *metadata) addPin(dgst, dir digest.Digest) error {
+	_, err := m.update(dgst, func(rec *contentRecord) error {
+		if !containsDigest(rec.Pins, dir) {
+			rec.Pins = append(rec.Pins, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.Bucket(bucketKeyPins).CreateBucketIfNotExists([]byte(dir))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(dgst), []byte{})
+	})
+}
+
+// pinnedFor returns whether the directory at dir is pinned on behalf of any
+// content.
+func (m *metadata) pinnedFor(dir digest.Digest) (bool, error) {
+	var pinned bool
+	err := m.db.View(func(tx *bolt.Tx) error {
+		pinned = tx.Bucket(bucketKeyPins).Bucket([]byte(dir)) != nil
+		return nil
+	})
+	return pinned, err
+}
+
+// removePins forgets the directories pinned on behalf of the content at dgst,
+// and returns the ones that are no longer pinned on behalf of any content.
+func (m *metadata) removePins(dgst digest.Digest) ([]digest.Digest, error) {
+	var released []digest.Digest
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		rec, err := readRecord(tx, dgst)
+		if err != nil {
+			return err
+		}
+
+		pins := tx.Bucket(bucketKeyPins)
+		for _, dir := range rec.Pins {
+			bkt := pins.Bucket([]byte(dir))
+			if bkt == nil {
+				continue
+			}
+
+			err = bkt.Delete([]byte(dgst))
+			if err != nil {
+				return err
+			}
+
+			if k, _ := bkt.Cursor().First(); k != nil {
+				continue
+			}
+
+			err = pins.DeleteBucket([]byte(dir))
+			if err != nil {
+				return err
+			}
+			released = append(released, dir)
+		}
+
+		if len(rec.Pins) == 0 {
+			return nil
+		}
+		rec.Pins = nil
+		return writeRecord(tx, dgst, rec)
+	})
+	return released, err
+}
+
+// addDigest records that the content at dgst is known by d through the store.
+func (m *metadata) addDigest(dgst, d digest.Digest) error {
+	_, err := m.update(dgst, func(rec *contentRecord) error {
+		if !containsDigest(rec.Digests, d) {
+			rec.Digests = append(rec.Digests, d)
+		}
+		return nil
+	})
+	return err
+}
+
+// removeDigest forgets that the content at dgst is known by d, including as
+// an alias.
+func (m *metadata) removeDigest(dgst, d digest.Digest) error {
+	_, err := m.update(dgst, func(rec *contentRecord) error {
+		rec.Digests = removeDigest(rec.Digests, d)
+		rec.Aliases = removeDigest(rec.Aliases, d)
+		rec.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil || d == dgst {
+		return err
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeyAliases).Delete([]byte(d))
+	})
+}
+
+func containsDigest(dgsts []digest.Digest, d digest.Digest) bool {
+	for _, dgst := range dgsts {
+		if dgst == d {
+			return true
+		}
+	}
+	return false
+}
+
+func removeDigest(dgsts []digest.Digest, d digest.Digest) []digest.Digest {
+	var kept []digest.Digest
+	for _, dgst := range dgsts {
+		if dgst != d {
+			kept = append(kept, dgst)
+		}
+	}
+	return kept
+}
+
+func readRecord(tx *bolt.Tx, dgst digest.Digest) (contentRecord, error) {
+	var rec contentRecord
+
+	data := tx.Bucket(bucketKeyContent).Get([]byte(dgst))
+	if data == nil {
+		return rec, nil
+	}
+
+	err := json.Unmarshal(data, &rec)
+	if err != nil {
+		return rec, errors.Wrapf(err, "failed to unmarshal record for %q", dgst)
+	}
+
+	return rec, nil
+}
+
+func writeRecord(tx *bolt.Tx, dgst digest.Digest, rec contentRecord) error {
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal record for %q", dgst)
+	}
+
+	return tx.Bucket(bucketKeyContent).Put([]byte(dgst), data)
+}
+
+// committed returns whether the content of rec has been committed, or found to
+// exist, through the store. Records are also created by looking up the info of
+// content, so their creation time does not tell.
+func (rec contentRecord) committed() bool {
+	return len(rec.Digests) > 0
+}
+
+// apply sets the stored fields of rec on info.
+func (rec contentRecord) apply(info *content.Info) {
+	info.Labels = rec.Labels
+	info.CreatedAt = rec.CreatedAt
+	info.UpdatedAt = rec.UpdatedAt
+}
@@ -0,0 +1,203 @@
+package ipcs
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	multihash "github.com/multiformats/go-multihash"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// AnnotationSourceRef is the annotation of a converted manifest or index
+	// with the reference of the image it was converted from.
+	AnnotationSourceRef = "com.github.hinshun.ipcs.source.ref"
+
+	// AnnotationSourceDigest is the annotation of a converted manifest, index,
+	// config or layer with the digest of the blob it was converted from.
+	AnnotationSourceDigest = "com.github.hinshun.ipcs.source.digest"
+
+	// AnnotationVersion is the annotation of a converted manifest or index with
+	// the version of ipcs that converted it.
+	AnnotationVersion = "com.github.hinshun.ipcs.version"
+
+	// AnnotationChunker is the annotation of a converted blob with the chunker
+	// it was added to IPFS with.
+	AnnotationChunker = "com.github.hinshun.ipcs.chunker"
+
+	// AnnotationCIDVersion is the annotation of a converted blob with the
+	// version of the CID it was added to IPFS as.
+	AnnotationCIDVersion = "com.github.hinshun.ipcs.cid-version"
+
+	// AnnotationRawLeaves is the annotation of a converted blob with whether
+	// its leaves were added to IPFS as raw blocks.
+	AnnotationRawLeaves = "com.github.hinshun.ipcs.raw-leaves"
+
+	// AnnotationHash is the annotation of a converted blob with the name of
+	// the multihash function it was added to IPFS with.
+	AnnotationHash = "com.github.hinshun.ipcs.hash"
+
+	// AnnotationLayout is the annotation of a converted blob with the layout
+	// of the DAG it was added to IPFS as.
+	AnnotationLayout = "com.github.hinshun.ipcs.layout"
+)
+
+// layoutNames are the names of the layouts of the DAGs content is added to
+// IPFS as.
+var layoutNames = map[options.Layout]string{
+	options.BalancedLayout: "balanced",
+	options.TrickleLayout:  "trickle",
+}
+
+// ParseLayout returns the layout named name, balanced or trickle.
+func ParseLayout(name string) (options.Layout, error) {
+	for layout, n := range layoutNames {
+		if n == name {
+			return layout, nil
+		}
+	}
+	return 0, errors.Wrapf(errdefs.ErrInvalidArgument, "unknown layout %q", name)
+}
+
+// ParseHashFunction returns the code of the multihash function named name,
+// e.g. sha2-256 or blake2b-256.
+func ParseHashFunction(name string) (uint64, error) {
+	code, ok := multihash.Names[name]
+	if !ok {
+		return 0, errors.Wrapf(errdefs.ErrInvalidArgument, "unknown hash function %q", name)
+	}
+	return code, nil
+}
+
+// Version is the version of ipcs recorded on the images it converts. It is
+// set at build time with -ldflags "-X github.com/hinshun/ipcs.Version=...".
+var Version = "v0.0.0+unknown"
+
+// Provenance is what a converted image, or one of its blobs, was converted
+// from, as recorded in its annotations.
+type Provenance struct {
+	MediaType    string            `json:"mediaType,omitempty"`
+	Digest       digest.Digest     `json:"digest"`
+	Platform     *ocispec.Platform `json:"platform,omitempty"`
+	SourceRef    string            `json:"sourceRef,omitempty"`
+	SourceDigest digest.Digest     `json:"sourceDigest,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	Chunker      string            `json:"chunker,omitempty"`
+	CIDVersion   string            `json:"cidVersion,omitempty"`
+	RawLeaves    string            `json:"rawLeaves,omitempty"`
+	Hash         string            `json:"hash,omitempty"`
+	Layout       string            `json:"layout,omitempty"`
+
+	// Manifests is the provenance of the manifests of an index.
+	Manifests []Provenance `json:"manifests,omitempty"`
+
+	// Config and Layers are the provenance of the blobs of a manifest.
+	Config *Provenance  `json:"config,omitempty"`
+	Layers []Provenance `json:"layers,omitempty"`
+}
+
+// ReadProvenance reads the provenance of a converted image specified by its
+// descriptor, and of the manifests and blobs it refers to, from provider.
+func ReadProvenance(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) (Provenance, error) {
+	p, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return Provenance{}, errors.Wrapf(err, "failed to read %q", desc.Digest)
+	}
+
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		err = json.Unmarshal(p, &idx)
+		if err != nil {
+			return Provenance{}, errors.Wrapf(err, "failed to unmarshal index %q", desc.Digest)
+		}
+
+		prov := provenanceOf(desc, idx.Annotations)
+		for _, mfst := range idx.Manifests {
+			mprov, err := ReadProvenance(ctx, provider, mfst)
+			if err != nil {
+				return Provenance{}, err
+			}
+			mprov.Platform = mfst.Platform
+
+			prov.Manifests = append(prov.Manifests, mprov)
+		}
+
+		return prov, nil
+	default:
+		var mfst ocispec.Manifest
+		err = json.Unmarshal(p, &mfst)
+		if err != nil {
+			return Provenance{}, errors.Wrapf(err, "failed to unmarshal manifest %q", desc.Digest)
+		}
+
+		prov := provenanceOf(desc, mfst.Annotations)
+		config := provenanceOf(mfst.Config, mfst.Config.Annotations)
+		prov.Config = &config
+		for _, layer := range mfst.Layers {
+			prov.Layers = append(prov.Layers, provenanceOf(layer, layer.Annotations))
+		}
+
+		return prov, nil
+	}
+}
+
+func provenanceOf(desc ocispec.Descriptor, annotations map[string]string) Provenance {
+	return Provenance{
+		MediaType:    desc.MediaType,
+		Digest:       desc.Digest,
+		SourceRef:    annotations[AnnotationSourceRef],
+		SourceDigest: digest.Digest(annotations[AnnotationSourceDigest]),
+		Version:      annotations[AnnotationVersion],
+		Chunker:      annotations[AnnotationChunker],
+		CIDVersion:   annotations[AnnotationCIDVersion],
+		RawLeaves:    annotations[AnnotationRawLeaves],
+		Hash:         annotations[AnnotationHash],
+		Layout:       annotations[AnnotationLayout],
+	}
+}
+
+// blobAnnotations returns annotations with the provenance of a blob converted
+// from src added.
+func (c *converter) blobAnnotations(annotations map[string]string, src digest.Digest) (map[string]string, error) {
+	settings, prefix, err := options.UnixfsAddOptions(c.addOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid unixfs add options")
+	}
+
+	annotated := make(map[string]string, len(annotations)+6)
+	for k, v := range annotations {
+		annotated[k] = v
+	}
+	annotated[AnnotationSourceDigest] = src.String()
+	annotated[AnnotationChunker] = settings.Chunker
+	annotated[AnnotationCIDVersion] = strconv.FormatUint(prefix.Version, 10)
+	annotated[AnnotationRawLeaves] = strconv.FormatBool(settings.RawLeaves)
+	annotated[AnnotationHash] = multihash.Codes[prefix.MhType]
+	annotated[AnnotationLayout] = layoutNames[settings.Layout]
+
+	return annotated, nil
+}
+
+// imageAnnotations returns annotations with the provenance of a manifest or
+// index converted from src added.
+func (c *converter) imageAnnotations(annotations map[string]string, src digest.Digest) (map[string]string, error) {
+	annotated, err := c.blobAnnotations(annotations, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.sourceRef != "" {
+		annotated[AnnotationSourceRef] = c.sourceRef
+	}
+	annotated[AnnotationVersion] = Version
+
+	return annotated, nil
+}
@@ -0,0 +1,81 @@
+package ipcs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertProvenance(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	img := newTestImage(t, root, randomData(t, 4096), randomData(t, 1024))
+	provider := img.provider
+	idx := writeTestIndex(t, img)
+
+	backend := NewMemoryBackend()
+	converter := NewConverter(backend, provider,
+		WithSourceRef("docker.io/library/alpine:latest"),
+		WithConverterConfig(Config{Chunker: "size-1024", Hash: "sha2-512"}),
+	)
+	desc, err := converter.Convert(ctx, idx)
+	require.NoError(t, err)
+
+	cs, err := NewContentStoreFromBackend(backend)
+	require.NoError(t, err)
+
+	prov, err := ReadProvenance(ctx, cs, desc)
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, prov.Digest)
+	require.Equal(t, "docker.io/library/alpine:latest", prov.SourceRef)
+	require.Equal(t, idx.Digest, prov.SourceDigest)
+	require.Equal(t, Version, prov.Version)
+
+	require.Len(t, prov.Manifests, 1)
+	mprov := prov.Manifests[0]
+	require.Equal(t, "docker.io/library/alpine:latest", mprov.SourceRef)
+	require.Equal(t, img.manifest.Digest, mprov.SourceDigest)
+	require.Equal(t, Version, mprov.Version)
+	require.Equal(t, "size-1024", mprov.Chunker)
+	require.Equal(t, "1", mprov.CIDVersion)
+	require.Equal(t, platforms.DefaultSpec(), *mprov.Platform)
+
+	// Every blob records the digest it was converted from.
+	mfst, err := images.Manifest(ctx, provider, img.manifest, platforms.Default())
+	require.NoError(t, err)
+
+	require.NotNil(t, mprov.Config)
+	require.Equal(t, mfst.Config.Digest, mprov.Config.SourceDigest)
+	require.NotEqual(t, mfst.Config.Digest, mprov.Config.Digest)
+
+	require.Len(t, mprov.Layers, len(mfst.Layers))
+	for i, layer := range mprov.Layers {
+		require.Equal(t, mfst.Layers[i].Digest, layer.SourceDigest)
+		require.Equal(t, "size-1024", layer.Chunker)
+		require.Equal(t, "1", layer.CIDVersion)
+		require.Empty(t, layer.SourceRef)
+	}
+
+	// Images converted without a reference are still annotated with the rest.
+	desc, err = NewConverter(backend, provider, WithConverterConfig(Config{})).Convert(ctx, img.manifest)
+	require.NoError(t, err)
+
+	prov, err = ReadProvenance(ctx, cs, desc)
+	require.NoError(t, err)
+	require.Empty(t, prov.SourceRef)
+	require.Equal(t, img.manifest.Digest, prov.SourceDigest)
+
+	settings, _, err := options.UnixfsAddOptions()
+	require.NoError(t, err)
+	require.Equal(t, settings.Chunker, prov.Chunker)
+}
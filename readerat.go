@@ -0,0 +1,205 @@
+package ipcs
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	merkledag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/pkg/errors"
+)
+
+// dagReaderAt is a content.ReaderAt for a UnixFS file. Every ReadAt descends
+// from the root node using the block sizes recorded in the UnixFS nodes, so
+// that only the blocks covering the requested range are fetched.
+type dagReaderAt struct {
+	ctx    context.Context
+	cancel func()
+	ng     ipld.NodeGetter
+	root   ipld.Node
+	size   int64
+
+	// mu guards the nodes already fetched. Intermediate nodes are small and
+	// visited by every ReadAt, so they are all kept. Only the last leaf is
+	// kept, which serves the common case of sequential reads that are
+	// smaller than a block.
+	mu       sync.Mutex
+	branches map[cid.Cid]ipld.Node
+	leaf     ipld.Node
+}
+
+func newDagReaderAt(ctx context.Context, ng ipld.NodeGetter, root ipld.Node) (*dagReaderAt, error) {
+	size, err := fileSize(root)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &dagReaderAt{
+		ctx:      ctx,
+		cancel:   cancel,
+		ng:       ng,
+		root:     root,
+		size:     int64(size),
+		branches: make(map[cid.Cid]ipld.Node),
+	}, nil
+}
+
+func (ra *dagReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("invalid offset")
+	}
+
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+
+	// Reads past the end of the file are short, which must be reported with
+	// io.EOF.
+	var eof error
+	if max := ra.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = io.EOF
+	}
+
+	n, err := ra.readAt(ra.root, p, off)
+	if err != nil {
+		return n, err
+	}
+
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, eof
+}
+
+func (ra *dagReaderAt) Size() int64 {
+	return ra.size
+}
+
+func (ra *dagReaderAt) Close() error {
+	ra.cancel()
+	return nil
+}
+
+// readAt reads into p from the file rooted at nd, starting at off bytes into
+// that file.
+func (ra *dagReaderAt) readAt(nd ipld.Node, p []byte, off int64) (int, error) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return copyAt(p, nd.RawData(), off), nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to decode unixfs node %q", nd.Cid())
+		}
+
+		switch fsn.Type() {
+		case unixfs.TFile, unixfs.TRaw:
+		default:
+			return 0, errors.Errorf("unsupported unixfs type %s for %q", fsn.Type(), nd.Cid())
+		}
+
+		if len(nd.Links()) > 0 && fsn.NumChildren() != len(nd.Links()) {
+			return 0, errors.Errorf("unixfs node %q is missing block sizes", nd.Cid())
+		}
+
+		var n int
+		data := fsn.Data()
+		if off < int64(len(data)) {
+			n = copyAt(p, data, off)
+		}
+
+		// Children follow the data of the node itself.
+		start := int64(len(data))
+		for i, link := range nd.Links() {
+			if n == len(p) {
+				break
+			}
+
+			end := start + int64(fsn.BlockSize(i))
+			if off+int64(n) < end {
+				child, err := ra.child(link.Cid)
+				if err != nil {
+					return n, err
+				}
+
+				m, err := ra.readAt(child, p[n:], off+int64(n)-start)
+				n += m
+				if err != nil {
+					return n, err
+				}
+			}
+			start = end
+		}
+
+		return n, nil
+	default:
+		return 0, errors.Errorf("unsupported node type %T for %q", nd, nd.Cid())
+	}
+}
+
+// child fetches a node linked from the file, reusing previously fetched nodes
+// where possible.
+func (ra *dagReaderAt) child(c cid.Cid) (ipld.Node, error) {
+	ra.mu.Lock()
+	nd, ok := ra.branches[c]
+	if !ok && ra.leaf != nil && ra.leaf.Cid() == c {
+		nd, ok = ra.leaf, true
+	}
+	ra.mu.Unlock()
+
+	if ok {
+		return nd, nil
+	}
+
+	nd, err := ra.ng.Get(ra.ctx, c)
+	if err != nil {
+		return nil, errors.Wrapf(ipfsError(err), "failed to get node %q", c)
+	}
+
+	ra.mu.Lock()
+	if len(nd.Links()) > 0 {
+		ra.branches[c] = nd
+	} else {
+		ra.leaf = nd
+	}
+	ra.mu.Unlock()
+
+	return nd, nil
+}
+
+// fileSize returns the size of the UnixFS file rooted at nd.
+func fileSize(nd ipld.Node) (uint64, error) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return uint64(len(nd.RawData())), nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to decode unixfs node %q", nd.Cid())
+		}
+
+		switch fsn.Type() {
+		case unixfs.TFile, unixfs.TRaw:
+			return fsn.FileSize(), nil
+		default:
+			return 0, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported unixfs type %s for %q", fsn.Type(), nd.Cid())
+		}
+	default:
+		return 0, errors.Wrapf(errdefs.ErrNotImplemented, "unsupported node type %T for %q", nd, nd.Cid())
+	}
+}
+
+func copyAt(dst, src []byte, off int64) int {
+	if off >= int64(len(src)) {
+		return 0
+	}
+	return copy(dst, src[off:])
+}
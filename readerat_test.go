@@ -0,0 +1,149 @@
+package ipcs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// countingNodeGetter counts the nodes fetched through it.
+type countingNodeGetter struct {
+	ipld.NodeGetter
+	count int64
+}
+
+func (ng *countingNodeGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	atomic.AddInt64(&ng.count, 1)
+	return ng.NodeGetter.Get(ctx, c)
+}
+
+func addTestFile(t *testing.T, backend *testBackend, data []byte) ocispec.Descriptor {
+	p, err := backend.Add(context.Background(), files.NewBytesFile(data), options.Unixfs.Pin(true))
+	require.NoError(t, err)
+
+	dgst, err := digestconv.CidToDigest(p.Cid())
+	require.NoError(t, err)
+
+	return ocispec.Descriptor{
+		Digest: dgst,
+		Size:   int64(len(data)),
+	}
+}
+
+func TestReaderAtRandomAccess(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 3<<20)
+	desc := addTestFile(t, backend, data)
+
+	ra, err := s.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+	require.Equal(t, int64(len(data)), ra.Size())
+
+	// Read backwards through the file in uneven chunks that straddle blocks.
+	p := make([]byte, 100003)
+	for off := int64(len(data)) - int64(len(p)); off >= 0; off -= int64(len(p)) {
+		n, err := ra.ReadAt(p, off)
+		require.NoError(t, err)
+		require.Equal(t, len(p), n)
+		require.Equal(t, data[off:off+int64(n)], p[:n])
+	}
+
+	n, err := ra.ReadAt(p, int64(len(data))-10)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, data[len(data)-10:], p[:n])
+
+	_, err = ra.ReadAt(p, int64(len(data)))
+	require.Equal(t, io.EOF, err)
+
+	actual, err := content.ReadBlob(ctx, s, desc)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, actual))
+}
+
+func TestReaderAtConcurrent(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 2<<20)
+	desc := addTestFile(t, backend, data)
+
+	ra, err := s.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 32; j++ {
+				p := make([]byte, rnd.Intn(64*1024)+1)
+				off := rnd.Int63n(int64(len(data) - len(p)))
+
+				n, err := ra.ReadAt(p, off)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if !bytes.Equal(data[off:off+int64(n)], p) {
+					t.Errorf("unexpected data at offset %d", off)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
+
+func TestReaderAtFetchesCoveringBlocks(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	data := randomData(t, 4<<20)
+	desc := addTestFile(t, backend, data)
+
+	c, err := digestconv.DigestToCid(desc.Digest)
+	require.NoError(t, err)
+
+	root, err := backend.dag.Get(ctx, c)
+	require.NoError(t, err)
+
+	ng := &countingNodeGetter{NodeGetter: backend.dag}
+	ra, err := newDagReaderAt(ctx, ng, root)
+	require.NoError(t, err)
+	defer ra.Close()
+
+	// A small read in the middle of the file only needs a single leaf.
+	p := make([]byte, 1024)
+	off := int64(len(data) / 2)
+	_, err = ra.ReadAt(p, off)
+	require.NoError(t, err)
+	require.Equal(t, data[off:off+int64(len(p))], p)
+	require.Equal(t, int64(1), atomic.LoadInt64(&ng.count))
+
+	// Reading further into the same leaf reuses it.
+	_, err = ra.ReadAt(p, off+int64(len(p)))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&ng.count))
+}
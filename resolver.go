@@ -4,7 +4,6 @@ import (
 	"context"
 	"io"
 
-	"github.com/hinshun/ipcs/digestconv"
 	files "github.com/ipfs/go-ipfs-files"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -12,14 +11,14 @@ import (
 )
 
 func (s *store) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
-	c, err := digestconv.DigestToCid(desc.Digest)
+	c, _, err := s.resolve(desc.Digest)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to convert digest '%s' to cid", desc.Digest)
+		return nil, err
 	}
 
-	n, err := s.cln.Unixfs().Get(ctx, path.IpfsPath(c))
+	n, err := s.backend.Get(ctx, path.IpfsPath(c))
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get unixfs node %q", c)
+		return nil, errors.Wrapf(ipfsError(err), "failed to get unixfs node %q", c)
 	}
 
 	return files.ToFile(n), nil
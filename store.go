@@ -1,31 +1,319 @@
 package ipcs
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
 	"github.com/containerd/containerd/content"
-	httpapi "github.com/ipfs/go-ipfs-http-client"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
 	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
-type Config struct {
-	IpfsPath string
-}
+// defaultProbeTimeout is how long checking whether IPFS has content locally
+// may take.
+const defaultProbeTimeout = 5 * time.Second
 
 type store struct {
-	cln iface.CoreAPI
+	backend Backend
+	meta    *metadata
+
+	// addOpts are the options content written to the store is added with.
+	addOpts     []options.UnixfsAddOption
+	concurrency int
+
+	// pinMode is how committed content is pinned.
+	pinMode PinMode
+
+	// probeTimeout bounds checking whether IPFS has content locally.
+	probeTimeout time.Duration
+
+	// ingests holds every writer that is currently open, keyed by its ref.
+	ingests   map[string]*writer
+	ingestsMu sync.Mutex
+
+	// partials counts the ingests whose partial data is pinned at a CID, which
+	// is not content until it is committed.
+	partials   map[cid.Cid]int
+	partialsMu sync.Mutex
+
+	// aliases holds the aliases imported from CID indexes when the store has
+	// no metadata to record them in.
+	aliases   map[digest.Digest]digest.Digest
+	aliasesMu sync.Mutex
+
+	// pins holds the directories pinned on behalf of content when the store
+	// has no metadata to record them in.
+	pins   map[digest.Digest][]digest.Digest
+	pinsMu sync.Mutex
+}
+
+// StoreOpt configures a content store.
+type StoreOpt func(*store) error
+
+// WithRootDir keeps the local metadata of the content store in root.
+func WithRootDir(root string) StoreOpt {
+	return func(s *store) error {
+		err := os.MkdirAll(root, 0711)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create root directory %q", root)
+		}
+
+		s.meta, err = openMetadata(filepath.Join(root, "metadata.db"))
+		return err
+	}
+}
+
+// WithOffline restricts the content store to the blocks IPFS has locally, so
+// that it never fetches content from the network.
+func WithOffline() StoreOpt {
+	return func(s *store) error {
+		backend, err := s.backend.Offline()
+		if err != nil {
+			return errors.Wrap(err, "failed to create offline ipfs backend")
+		}
+
+		s.backend = backend
+		return nil
+	}
+}
+
+// WithConfig applies cfg to the content store, including its RootDir.
+func WithConfig(cfg Config) StoreOpt {
+	return func(s *store) error {
+		err := cfg.Validate()
+		if err != nil {
+			return err
+		}
+
+		s.addOpts = cfg.unixfsAddOptions()
+		if cfg.PinMode != "" {
+			s.pinMode = cfg.PinMode
+		}
+		if cfg.MaxConcurrency > 0 {
+			s.concurrency = cfg.MaxConcurrency
+		}
+		if cfg.ProbeTimeout > 0 {
+			s.probeTimeout = time.Duration(cfg.ProbeTimeout)
+		}
+
+		if cfg.Offline {
+			err = WithOffline()(s)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cfg.RootDir == "" {
+			return nil
+		}
+		return WithRootDir(cfg.RootDir)(s)
+	}
 }
 
-func NewContentStore(cfg Config) (content.Store, error) {
-	cln, err := httpapi.NewPathApi(cfg.IpfsPath)
+// NewContentStore returns a content store on the IPFS configured by cfg. An
+// embedded IPFS node runs until ctx is canceled.
+func NewContentStore(ctx context.Context, cfg Config) (content.Store, error) {
+	cln, err := cfg.NewCoreAPI(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create ipfs client")
+		return nil, err
 	}
 
+	return NewContentStoreFromCoreAPI(cln, WithConfig(cfg))
+}
+
+func NewContentStoreFromCoreAPI(cln iface.CoreAPI, opts ...StoreOpt) (content.Store, error) {
+	return NewContentStoreFromBackend(NewCoreAPIBackend(cln), opts...)
+}
+
+func NewContentStoreFromBackend(backend Backend, opts ...StoreOpt) (content.Store, error) {
+	s := newStore(backend)
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.meta != nil {
+		s.unpinStalePartials(context.Background())
+	}
+
+	return s, nil
+}
+
+func newStore(backend Backend) *store {
 	return &store{
-		cln: cln,
-	}, nil
+		backend:      backend,
+		concurrency:  walkConcurrency,
+		pinMode:      PinRecursive,
+		probeTimeout: defaultProbeTimeout,
+		ingests:      make(map[string]*writer),
+		partials:     make(map[cid.Cid]int),
+		aliases:      make(map[digest.Digest]digest.Digest),
+		pins:         make(map[digest.Digest][]digest.Digest),
+	}
 }
 
-func NewContentStoreFromCoreAPI(cln iface.CoreAPI) content.Store {
-	return &store{cln}
+// resolve returns the CID of the content known by dgst, which is either the
+// digest of the CID or an alias such as the sha256 of the content's bytes. The
+// digest of the CID is returned as well, since it keys the metadata.
+func (s *store) resolve(dgst digest.Digest) (cid.Cid, digest.Digest, error) {
+	s.aliasesMu.Lock()
+	key, ok := s.aliases[dgst]
+	s.aliasesMu.Unlock()
+
+	if !ok {
+		key = dgst
+	}
+	if !ok && s.meta != nil {
+		var err error
+		key, err = s.meta.resolve(dgst)
+		if err != nil {
+			return cid.Cid{}, "", errors.Wrapf(err, "failed to resolve alias %q", dgst)
+		}
+	}
+
+	c, err := digestconv.DigestToCid(key)
+	if err != nil {
+		return cid.Cid{}, "", errors.Wrapf(errdefs.ErrInvalidArgument, "failed to convert digest %q to cid: %v", key, err)
+	}
+
+	return c, key, nil
+}
+
+// addAlias records alias as another digest of the content at dgst, in the
+// metadata if the store has it, and in memory otherwise.
+func (s *store) addAlias(dgst, alias digest.Digest) error {
+	if s.meta != nil {
+		err := s.meta.addAlias(dgst, alias)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add alias %q of %q", alias, dgst)
+		}
+		return nil
+	}
+
+	s.aliasesMu.Lock()
+	s.aliases[alias] = dgst
+	s.aliasesMu.Unlock()
+	return nil
+}
+
+// addPin records that the directory at dir is pinned on behalf of the content
+// at dgst, such as the files of a file-granular layer on behalf of its
+// metadata, so that it is unpinned once the content is deleted, unless it is
+// still pinned on behalf of other content.
+func (s *store) addPin(dgst, dir digest.Digest) error {
+	if s.meta != nil {
+		err := s.meta.addPin(dgst, dir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add pin %q of %q", dir, dgst)
+		}
+		return nil
+	}
+
+	s.pinsMu.Lock()
+	if !containsDigest(s.pins[dgst], dir) {
+		s.pins[dgst] = append(s.pins[dgst], dir)
+	}
+	s.pinsMu.Unlock()
+	return nil
+}
+
+// pinnedFor returns whether the directory at dir is pinned on behalf of any
+// content.
+func (s *store) pinnedFor(dir digest.Digest) (bool, error) {
+	if s.meta != nil {
+		pinned, err := s.meta.pinnedFor(dir)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to look up pin %q", dir)
+		}
+		return pinned, nil
+	}
+
+	s.pinsMu.Lock()
+	defer s.pinsMu.Unlock()
+
+	for _, dirs := range s.pins {
+		if containsDigest(dirs, dir) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unpinDirs unpins the directories pinned on behalf of the content at dgst that
+// are not pinned on behalf of other content.
+func (s *store) unpinDirs(ctx context.Context, dgst digest.Digest) error {
+	var released []digest.Digest
+	if s.meta != nil {
+		var err error
+		released, err = s.meta.removePins(dgst)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove pins of %q", dgst)
+		}
+	} else {
+		s.pinsMu.Lock()
+		dirs := s.pins[dgst]
+		delete(s.pins, dgst)
+		for _, dir := range dirs {
+			var pinned bool
+			for _, other := range s.pins {
+				pinned = pinned || containsDigest(other, dir)
+			}
+			if !pinned {
+				released = append(released, dir)
+			}
+		}
+		s.pinsMu.Unlock()
+	}
+
+	for _, dir := range released {
+		c, err := digestconv.DigestToCid(dir)
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert digest %q to cid", dir)
+		}
+
+		err = s.backend.Unpin(ctx, path.IpfsPath(c), options.Pin.RmRecursive(true))
+		if err != nil && !errdefs.IsNotFound(ipfsError(err)) {
+			return errors.Wrapf(ipfsError(err), "failed to remove pin of %q", dir)
+		}
+	}
+	return nil
+}
+
+// localSize returns the size of the content at c, or ErrNotFound if IPFS does
+// not have its root block locally. It never fetches blocks from the network,
+// and gives up with ErrUnavailable once the probe timeout has passed.
+func (s *store) localSize(ctx context.Context, c cid.Cid) (int64, error) {
+	local, err := s.backend.Offline()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create offline ipfs backend")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.probeTimeout)
+	defer cancel()
+
+	nd, err := local.Dag().Get(ctx, c)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, errors.Wrapf(errdefs.ErrUnavailable, "timed out looking up %q locally", c)
+		}
+		return 0, errors.Wrapf(ipfsError(err), "failed to get root node %q", c)
+	}
+
+	size, err := fileSize(nd)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(size), nil
 }
@@ -0,0 +1,202 @@
+package ipcs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/hinshun/ipcs/digestconv"
+	cid "github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	unixfile "github.com/ipfs/go-unixfs/file"
+	"github.com/ipfs/go-unixfs/importer"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend is an in-memory backend that can also fetch the blocks it does
+// not have locally from a remote DAG, as if from the network.
+type testBackend struct {
+	*memoryBackend
+	*testNetwork
+
+	offline bool
+}
+
+// testNetwork holds the blocks a testBackend can only fetch from the network.
+type testNetwork struct {
+	remote ipld.DAGService
+
+	mu      sync.Mutex
+	fetches int
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		memoryBackend: NewMemoryBackend().(*memoryBackend),
+		testNetwork:   &testNetwork{remote: mdtest.Mock()},
+	}
+}
+
+func (b *testBackend) Get(ctx context.Context, p path.Path) (files.Node, error) {
+	dag := b.nodes()
+	nd, err := dag.Get(ctx, p.(path.Resolved).Cid())
+	if err != nil {
+		return nil, err
+	}
+
+	return unixfile.NewUnixfsFile(ctx, dag, nd)
+}
+
+func (b *testBackend) Dag() ipld.NodeGetter {
+	return b.nodes()
+}
+
+func (b *testBackend) Offline() (Backend, error) {
+	return &testBackend{
+		memoryBackend: b.memoryBackend,
+		testNetwork:   b.testNetwork,
+		offline:       true,
+	}, nil
+}
+
+// nodes returns the blocks the backend can get, which are only the local ones
+// when it is offline.
+func (b *testBackend) nodes() ipld.DAGService {
+	if b.offline {
+		return b.dag
+	}
+	return &testNetworkDAG{DAGService: b.dag, net: b.testNetwork}
+}
+
+func (b *testBackend) fetchCount() int {
+	b.testNetwork.mu.Lock()
+	defer b.testNetwork.mu.Unlock()
+
+	return b.fetches
+}
+
+func (b *testBackend) isPinned(c cid.Cid) bool {
+	b.memoryBackend.mu.Lock()
+	defer b.memoryBackend.mu.Unlock()
+
+	_, ok := b.pins[c]
+	return ok
+}
+
+// testNetworkDAG gets the nodes missing locally from the remote blocks, as if
+// they were fetched from the network.
+type testNetworkDAG struct {
+	ipld.DAGService
+	net *testNetwork
+}
+
+func (dag *testNetworkDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := dag.DAGService.Get(ctx, c)
+	if err != ipld.ErrNotFound {
+		return nd, err
+	}
+
+	nd, err = dag.net.remote.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	dag.net.mu.Lock()
+	dag.net.fetches++
+	dag.net.mu.Unlock()
+	return nd, nil
+}
+
+func (dag *testNetworkDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := dag.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+// testDigest returns the digest of the UnixFS file ipcs creates for data.
+func testDigest(t *testing.T, data []byte) digest.Digest {
+	nd, err := importer.BuildDagFromReader(mdtest.Mock(), chunker.DefaultSplitter(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	dgst, err := digestconv.CidToDigest(nd.Cid())
+	require.NoError(t, err)
+	return dgst
+}
+
+// addRemoteFile adds data to the blocks the node can only fetch from the
+// network.
+func addRemoteFile(t *testing.T, backend *testBackend, data []byte) ocispec.Descriptor {
+	nd, err := importer.BuildDagFromReader(backend.remote, chunker.DefaultSplitter(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	dgst, err := digestconv.CidToDigest(nd.Cid())
+	require.NoError(t, err)
+
+	return ocispec.Descriptor{Digest: dgst, Size: int64(len(data))}
+}
+
+func TestLocalProbes(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	s := newStore(backend)
+
+	data := randomData(t, 1<<20)
+	desc := addRemoteFile(t, backend, data)
+
+	// Content that is only on the network is not in the store.
+	_, err := s.Info(ctx, desc.Digest)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	w, err := s.Writer(ctx, content.WithRef("remote"), content.WithDescriptor(desc))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, s.Abort(ctx, "remote"))
+
+	require.Zero(t, backend.fetchCount())
+
+	// It can still be read, by fetching it.
+	p, err := content.ReadBlob(ctx, s, desc)
+	require.NoError(t, err)
+	require.Equal(t, data, p)
+	require.NotZero(t, backend.fetchCount())
+}
+
+func TestOfflineStore(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+
+	cs, err := NewContentStoreFromBackend(backend, WithOffline())
+	require.NoError(t, err)
+
+	desc := addRemoteFile(t, backend, randomData(t, 1024))
+
+	_, err = cs.ReaderAt(ctx, desc)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	_, err = cs.(*store).Fetch(ctx, desc)
+	require.True(t, errdefs.IsNotFound(err), "%v", err)
+
+	require.Zero(t, backend.fetchCount())
+
+	// Content written to the store is local.
+	data := randomData(t, 1024)
+	err = content.WriteBlob(ctx, cs, "offline", bytes.NewReader(data), ocispec.Descriptor{Size: int64(len(data))})
+	require.NoError(t, err)
+
+	info, err := cs.Info(ctx, testDigest(t, data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+}
@@ -0,0 +1,23 @@
+package ipcs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/testsuite"
+)
+
+// TestContentSuite runs containerd's conformance suite for content stores
+// against a store on an in-memory IPFS node. The store needs a root directory
+// to pass: without metadata, content is committed by the digest of its CID
+// and committing existing content again succeeds.
+func TestContentSuite(t *testing.T) {
+	testsuite.ContentSuite(t, "ipcs", func(ctx context.Context, root string) (context.Context, content.Store, func() error, error) {
+		cs, err := NewContentStoreFromBackend(NewMemoryBackend(), WithRootDir(root))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return ctx, cs, func() error { return nil }, nil
+	})
+}
@@ -0,0 +1,114 @@
+package ipcs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/rootfs"
+	"github.com/containerd/containerd/snapshots"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// UnpackProgress is the progress of unpacking an image, reported once per
+// layer.
+type UnpackProgress struct {
+	// Layer is the descriptor of the layer in the manifest.
+	Layer ocispec.Descriptor
+
+	// Index is the index of the layer in the manifest, out of Total layers.
+	Index int
+	Total int
+
+	// Applied is false if the snapshot of the layer already existed.
+	Applied bool
+
+	// Duration is the time it took to unpack the layer.
+	Duration time.Duration
+}
+
+// unpack unpacks the layers of img for platform into snapshots of sn, the
+// snapshotter named snapshotter, like containerd's image.Unpack, except that
+// progress is called after each layer. The layers are applied by a, which is
+// containerd's diff service for a client, so p2p layers are read through ipcs
+// when it is the content store of containerd.
+func unpack(ctx context.Context, cs content.Store, sn snapshots.Snapshotter, a diff.Applier, img images.Image, snapshotter string, platform platforms.MatchComparer, progress func(UnpackProgress)) error {
+	manifest, err := images.Manifest(ctx, cs, img.Target, platform)
+	if err != nil {
+		return err
+	}
+
+	diffIDs, err := img.RootFS(ctx, cs, platform)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve rootfs")
+	}
+	if len(diffIDs) != len(manifest.Layers) {
+		return errors.Errorf("mismatched image rootfs and manifest layers")
+	}
+
+	var chain []digest.Digest
+	for i, blob := range manifest.Layers {
+		layer := rootfs.Layer{
+			Blob: blob,
+			Diff: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayer,
+				Digest:    diffIDs[i],
+			},
+		}
+
+		t1 := time.Now()
+		applied, err := rootfs.ApplyLayer(ctx, layer, chain, sn, a)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply layer %q", blob.Digest)
+		}
+
+		if applied {
+			// Set the uncompressed label after the uncompressed digest has been
+			// verified through apply.
+			cinfo := content.Info{
+				Digest: blob.Digest,
+				Labels: map[string]string{
+					labelUncompressed: layer.Diff.Digest.String(),
+				},
+			}
+			if _, err := cs.Update(ctx, cinfo, "labels."+labelUncompressed); err != nil {
+				return errors.Wrapf(err, "failed to label layer %q", blob.Digest)
+			}
+		}
+
+		chain = append(chain, layer.Diff.Digest)
+
+		if progress != nil {
+			progress(UnpackProgress{
+				Layer:    blob,
+				Index:    i,
+				Total:    len(manifest.Layers),
+				Applied:  applied,
+				Duration: time.Since(t1),
+			})
+		}
+	}
+
+	// The snapshot of the image is garbage collected with its config.
+	label := fmt.Sprintf("containerd.io/gc.ref.snapshot.%s", snapshotter)
+	cinfo := content.Info{
+		Digest: manifest.Config.Digest,
+		Labels: map[string]string{
+			label: identity.ChainID(chain).String(),
+		},
+	}
+
+	_, err = cs.Update(ctx, cinfo, "labels."+label)
+	if err != nil {
+		return errors.Wrapf(err, "failed to label config %q", manifest.Config.Digest)
+	}
+
+	return nil
+}
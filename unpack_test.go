@@ -0,0 +1,212 @@
+package ipcs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	cmetadata "github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testApplier records the layers it applies, and returns their diff IDs
+// without applying them.
+type testApplier struct {
+	cs content.Store
+
+	// diffID, if set, is returned for every layer instead.
+	diffID digest.Digest
+
+	mu      sync.Mutex
+	applied []digest.Digest
+}
+
+func (a *testApplier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount) (ocispec.Descriptor, error) {
+	a.mu.Lock()
+	a.applied = append(a.applied, desc.Digest)
+	a.mu.Unlock()
+
+	diffID := a.diffID
+	if diffID == "" {
+		ra, err := a.cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer ra.Close()
+
+		zr, err := gzip.NewReader(content.NewReader(ra))
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+
+		diffID, err = digest.FromReader(zr)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    diffID,
+	}, nil
+}
+
+// newTestLayers returns a gzipped layer with a file of each name.
+func newTestLayers(t *testing.T, names ...string) [][]byte {
+	var layers [][]byte
+	for _, name := range names {
+		_, layer := newTestLayer(t, testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}, data: []byte(name)})
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// newTestMetadataDB returns containerd's metadata stores over cs and a native
+// snapshotter named "native" in root, like the stores of a client.
+func newTestMetadataDB(t *testing.T, root string, cs content.Store) (*cmetadata.DB, *bolt.DB) {
+	sn, err := native.NewSnapshotter(filepath.Join(root, "native"))
+	require.NoError(t, err)
+
+	bdb, err := bolt.Open(filepath.Join(root, "metadata.db"), 0644, nil)
+	require.NoError(t, err)
+
+	mdb := cmetadata.NewDB(bdb, cs, map[string]snapshots.Snapshotter{"native": sn})
+	require.NoError(t, mdb.Init(context.Background()))
+
+	return mdb, bdb
+}
+
+func TestUnpack(t *testing.T) {
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	lcs, err := local.NewStore(filepath.Join(root, "content"))
+	require.NoError(t, err)
+
+	mdb, bdb := newTestMetadataDB(t, root, lcs)
+	defer bdb.Close()
+
+	var (
+		ctx = namespaces.WithNamespace(context.Background(), "test")
+		cs  = mdb.ContentStore()
+		sn  = mdb.Snapshotter("native")
+		a   = &testApplier{cs: cs}
+
+		amd64 = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+		arm64 = ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	)
+
+	amd64Img := writeTestImage(t, cs, amd64, newTestLayers(t, "base", "amd64"), withTestContext(ctx), withTestRootFS())
+	arm64Img := writeTestImage(t, cs, arm64, newTestLayers(t, "base", "arm64"), withTestContext(ctx), withTestRootFS())
+
+	img := images.Image{
+		Name:   "test",
+		Target: writeTestIndex(t, amd64Img, arm64Img),
+	}
+
+	unpackPlatform := func(platform ocispec.Platform) []UnpackProgress {
+		var progress []UnpackProgress
+		err := unpack(ctx, cs, sn, a, img, "native", platforms.Only(platform), func(p UnpackProgress) {
+			progress = append(progress, p)
+		})
+		require.NoError(t, err)
+		return progress
+	}
+
+	// Only the layers of the manifest of the platform are applied.
+	progress := unpackPlatform(arm64)
+	layers := arm64Img.blobs[2:]
+	require.Equal(t, []digest.Digest{layers[0].Digest, layers[1].Digest}, a.applied)
+
+	require.Len(t, progress, 2)
+	for i, p := range progress {
+		require.Equal(t, layers[i], p.Layer)
+		require.Equal(t, i, p.Index)
+		require.Equal(t, 2, p.Total)
+		require.True(t, p.Applied)
+	}
+
+	// Applied layers are labeled with their diff IDs.
+	for i, layer := range layers {
+		info, err := cs.Info(ctx, layer.Digest)
+		require.NoError(t, err)
+		require.Equal(t, arm64Img.diffIDs[i].String(), info.Labels[labelUncompressed])
+	}
+
+	// The snapshot of the image is committed under the chain ID of its diff
+	// IDs, and referenced by its config for the snapshotter.
+	arm64Chain := identity.ChainID(arm64Img.diffIDs)
+	info, err := sn.Stat(ctx, arm64Chain.String())
+	require.NoError(t, err)
+	require.Equal(t, snapshots.KindCommitted, info.Kind)
+
+	cinfo, err := cs.Info(ctx, arm64Img.blobs[1].Digest)
+	require.NoError(t, err)
+	require.Equal(t, arm64Chain.String(), cinfo.Labels[fmt.Sprintf("containerd.io/gc.ref.snapshot.%s", "native")])
+
+	// Layers whose snapshots already exist are not applied again, even for
+	// another platform.
+	a.applied = nil
+	progress = unpackPlatform(amd64)
+	require.Equal(t, []digest.Digest{amd64Img.blobs[3].Digest}, a.applied)
+
+	require.Len(t, progress, 2)
+	require.False(t, progress[0].Applied)
+	require.True(t, progress[1].Applied)
+
+	_, err = sn.Stat(ctx, identity.ChainID(amd64Img.diffIDs).String())
+	require.NoError(t, err)
+
+	// Unpacking a platform the image does not have is an error.
+	err = unpack(ctx, cs, sn, a, img, "native", platforms.Only(ocispec.Platform{OS: "windows", Architecture: "amd64"}), nil)
+	require.Error(t, err)
+}
+
+func TestUnpackMismatchedDiffID(t *testing.T) {
+	root, err := ioutil.TempDir("", "ipcs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	lcs, err := local.NewStore(filepath.Join(root, "content"))
+	require.NoError(t, err)
+
+	mdb, bdb := newTestMetadataDB(t, root, lcs)
+	defer bdb.Close()
+
+	var (
+		ctx      = namespaces.WithNamespace(context.Background(), "test")
+		cs       = mdb.ContentStore()
+		a        = &testApplier{cs: cs, diffID: digest.FromString("tampered")}
+		platform = platforms.DefaultSpec()
+	)
+
+	img := writeTestImage(t, cs, platform, newTestLayers(t, "base"), withTestContext(ctx), withTestRootFS())
+
+	// A layer that does not apply to the diff ID of the config fails the
+	// unpack, and is not labeled with it.
+	err = unpack(ctx, cs, mdb.Snapshotter("native"), a, images.Image{Name: "test", Target: withPlatform(img.manifest, platform)}, "native", platforms.Only(platform), nil)
+	require.Error(t, err)
+
+	info, err := cs.Info(ctx, img.blobs[2].Digest)
+	require.NoError(t, err)
+	require.Empty(t, info.Labels[labelUncompressed])
+}